@@ -0,0 +1,58 @@
+package spf
+
+import (
+	"context"
+	"sync"
+)
+
+// batchWorkers is the number of checks ValidateBatch runs at once.
+const batchWorkers = 8
+
+// Query is an IP and the domain it sends email for, to be checked together.
+type Query struct {
+	IP     string
+	Domain string
+}
+
+// BatchResult is the outcome of checking a Query.
+type BatchResult struct {
+	Query  Query
+	Result Result
+	Err    error
+}
+
+// ValidateBatch checks many queries at once using the built-in SPF Checker.
+// See Checker.ValidateBatch.
+func ValidateBatch(ctx context.Context, queries []Query) []BatchResult {
+	return looker.ValidateBatch(ctx, queries)
+}
+
+// ValidateBatch checks many queries at once, sharing the Checker's cache
+// between them. The results are in the order of the queries. Queries not yet
+// checked when the context is done result in TempError.
+func (sc *Checker) ValidateBatch(ctx context.Context, queries []Query) []BatchResult {
+	results := make([]BatchResult, len(queries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	workers := batchWorkers
+	if len(queries) < workers {
+		workers = len(queries)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				q := queries[i]
+				res, err := sc.ValidateContext(ctx, q.IP, q.Domain)
+				results[i] = BatchResult{Query: q, Result: res, Err: err}
+			}
+		}()
+	}
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,57 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBatch(t *testing.T) {
+	txt := map[string][]string{}
+	for i := 0; i < 5; i++ {
+		txt[fmt.Sprintf("%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 ip4:192.0.2.%d -all", i)}
+	}
+	_, f := fakeChecker(txt)
+	g := &gatedResolver{f, make(chan chan struct{}, 10), make(chan struct{})}
+	sc := NewSPFCheckerWithResolver(g)
+
+	var queries []Query
+	for i := 0; i < 40; i++ {
+		queries = append(queries, Query{IP: fmt.Sprintf("192.0.2.%d", i%2), Domain: fmt.Sprintf("%d.example.com", i%5)})
+	}
+	queries = append(queries, Query{IP: "192.0.2.1", Domain: "missing.example.com"})
+	batch := make(chan []BatchResult)
+	go func() { batch <- sc.ValidateBatch(context.Background(), queries) }()
+	// The domains are looked up at once, each only once.
+	for i := 0; i < 5; i++ {
+		<-g.started
+	}
+	close(g.release)
+	results := <-batch
+	assert.EqualValues(t, 6, atomic.LoadInt32(&f.queries))
+
+	if assert.Len(t, results, len(queries)) {
+		for i, r := range results {
+			assert.Equal(t, queries[i], r.Query)
+			assert.Nil(t, r.Err)
+			expected := Fail
+			if i == len(queries)-1 {
+				expected = None
+			} else if i%2 == i%5 {
+				expected = Pass
+			}
+			assert.Equal(t, expected, r.Result, "%v", r.Query)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range sc.ValidateBatch(ctx, queries[:3]) {
+		assert.Equal(t, TempError, r.Result)
+		assert.Equal(t, context.Canceled, r.Err)
+	}
+	assert.Empty(t, sc.ValidateBatch(context.Background(), nil))
+}
@@ -0,0 +1,174 @@
+package spf
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache stores the SPF records of domains for a Checker, which may be
+// shared by the Checkers of several processes. Its methods may be called
+// from more than one goroutine at once.
+type Cache interface {
+	// Get returns the cached SPF records of a domain, if there are any
+	// still to be used.
+	Get(domain string) ([]string, bool)
+	// Set caches the SPF records of a domain, in place of any it had.
+	Set(domain string, records []string)
+	// Delete removes the SPF records of a domain from the cache.
+	Delete(domain string)
+	// Dump empties the cache.
+	Dump()
+}
+
+// memoryCache is the Cache that Checkers are made with, holding records in
+// memory for a TTL and, if it has a capacity, evicting the least recently
+// used domains beyond it.
+type memoryCache struct {
+	mu sync.RWMutex
+	// entries holds the entries of lru by domain.
+	entries map[string]*list.Element
+	// lru orders the cached entries from most to least recently used.
+	lru *list.List
+	// ttl is how long records are cached for; zero caches them until the
+	// cache is dumped.
+	ttl time.Duration
+	// capacity is the number of domains cached before the least recently
+	// used is evicted; zero is unbounded.
+	capacity int
+}
+
+// cacheEntry is a domain's cached SPF records, or the error for a domain
+// without any.
+type cacheEntry struct {
+	domain  string
+	records []string
+	err     error
+	// dnssec is the DNSSEC status of the records, where known.
+	dnssec DNSSECStatus
+	// expires is when the records must be fetched again, or zero if they
+	// never need to be.
+	expires time.Time
+}
+
+// expired reports whether the entry's records must be fetched again.
+func (ce cacheEntry) expired() bool {
+	return !ce.expires.IsZero() && !now().Before(ce.expires)
+}
+
+func newMemoryCache(ttl time.Duration, capacity int) *memoryCache {
+	return &memoryCache{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		ttl:      ttl,
+		capacity: capacity,
+	}
+}
+
+// Get returns the unexpired cached records of a domain, and marks them as
+// recently used.
+func (c *memoryCache) Get(domain string) ([]string, bool) {
+	entry, ok := c.get(domain)
+	if !ok {
+		return nil, false
+	}
+	return entry.records, true
+}
+
+// Set caches the records of a domain, evicting the least recently used
+// domains beyond the cache's capacity.
+func (c *memoryCache) Set(domain string, records []string) {
+	c.set(domain, records, DNSSECUnknown)
+}
+
+// set is Set, keeping the DNSSEC status of the records too.
+func (c *memoryCache) set(domain string, records []string, dnssec DNSSECStatus) {
+	entry := &cacheEntry{domain: domain, records: records, dnssec: dnssec}
+	if c.ttl > 0 {
+		entry.expires = now().Add(c.ttl)
+	}
+	c.put(entry)
+}
+
+// get returns the unexpired cache entry of a domain, and marks it as
+// recently used. An expired entry is removed.
+func (c *memoryCache) get(domain string) (*cacheEntry, bool) {
+	entry, expired := c.peek(domain)
+	if expired {
+		c.mu.Lock()
+		if elem, ok := c.entries[domain]; ok && elem.Value.(*cacheEntry).expired() {
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+	}
+	return entry, entry != nil
+}
+
+// peek is get, leaving an expired entry in place but reporting it.
+func (c *memoryCache) peek(domain string) (*cacheEntry, bool) {
+	if c.capacity == 0 {
+		// Recency only matters when there is something to evict.
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+	} else {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	elem, ok := c.entries[domain]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.expired() {
+		return nil, true
+	}
+	if c.capacity > 0 {
+		c.lru.MoveToFront(elem)
+	}
+	return entry, false
+}
+
+// put caches an entry in place of any other for its domain, evicting the
+// least recently used domains beyond the cache's capacity, and any expired
+// ones among them.
+func (c *memoryCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.domain]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[entry.domain] = c.lru.PushFront(entry)
+	}
+	for c.capacity > 0 && c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	// Entries that are never asked for again would otherwise stay once they
+	// expire.
+	for oldest := c.lru.Back(); oldest != nil && oldest.Value.(*cacheEntry).expired(); oldest = c.lru.Back() {
+		c.remove(oldest)
+	}
+}
+
+// remove removes an entry from the cache, which must be locked.
+func (c *memoryCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).domain)
+}
+
+// Delete removes a domain's entry from the cache.
+func (c *memoryCache) Delete(domain string) {
+	c.mu.Lock()
+	if elem, ok := c.entries[domain]; ok {
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+}
+
+// Dump empties the cache.
+func (c *memoryCache) Dump() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.mu.Unlock()
+}
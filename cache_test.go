@@ -0,0 +1,466 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentValidate(t *testing.T) {
+	txt := map[string][]string{}
+	for i := 0; i < 10; i++ {
+		txt[fmt.Sprintf("%d.example.com", i)] = []string{"v=spf1 ip4:192.0.2.0/24 -all"}
+	}
+	sc, _ := fakeChecker(txt)
+	defer func(old *Checker) { looker = old }(looker)
+	looker = sc
+
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				ok, err := Validate("192.0.2.1", fmt.Sprintf("%d.example.com", (g+i)%10))
+				assert.Nil(t, err)
+				assert.True(t, ok)
+				if i%7 == 0 {
+					DumpCache()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestCacheTTL(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	f := &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 -all"}}}
+	sc := NewSPFCheckerWithTTL(time.Minute)
+	sc.resolver = f
+	check := func(expected Result, queries int32) {
+		res, err := sc.ValidateResult("192.0.2.1", "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res)
+		assert.Equal(t, queries, atomic.LoadInt32(&f.queries))
+	}
+	check(Fail, 1)
+	clock = clock.Add(59 * time.Second)
+	check(Fail, 1)
+
+	// Once expired, a changed policy is picked up.
+	f.txt["example.com"] = []string{"v=spf1 +all"}
+	clock = clock.Add(time.Second)
+	check(Pass, 2)
+	check(Pass, 2)
+
+	// Without a TTL, records are kept until the cache is dumped.
+	sc.Cache.(*memoryCache).ttl = 0
+	sc.DumpCache()
+	check(Pass, 3)
+	clock = clock.Add(24 * time.Hour)
+	check(Pass, 3)
+}
+
+func TestCacheCapacity(t *testing.T) {
+	f := &fakeResolver{txt: map[string][]string{
+		"a.example.com": {"v=spf1 -all"},
+		"b.example.com": {"v=spf1 -all"},
+		"c.example.com": {"v=spf1 -all"},
+	}}
+	sc := NewSPFCheckerWithCapacity(2)
+	sc.resolver = f
+	check := func(domain string, queries int32) {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, Fail, res)
+		assert.Equal(t, queries, atomic.LoadInt32(&f.queries), domain)
+	}
+	check("a.example.com", 1)
+	check("b.example.com", 2)
+	check("a.example.com", 2)
+	// b is now the least recently used, and makes way for c.
+	check("c.example.com", 3)
+	assert.Len(t, sc.Cache.(*memoryCache).entries, 2)
+	check("a.example.com", 3)
+	check("b.example.com", 4)
+	check("c.example.com", 5)
+	assert.Equal(t, 2, sc.Cache.(*memoryCache).lru.Len())
+}
+
+// mapCache is a Cache that records nothing but the records set in it.
+type mapCache struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (c *mapCache) Get(domain string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records, ok := c.records[domain]
+	return records, ok
+}
+
+func (c *mapCache) Set(domain string, records []string) {
+	c.mu.Lock()
+	c.records[domain] = records
+	c.mu.Unlock()
+}
+
+func (c *mapCache) Delete(domain string) {
+	c.mu.Lock()
+	delete(c.records, domain)
+	c.mu.Unlock()
+}
+
+func (c *mapCache) Dump() {
+	c.mu.Lock()
+	c.records = make(map[string][]string)
+	c.mu.Unlock()
+}
+
+func TestCustomCache(t *testing.T) {
+	cache := &mapCache{records: map[string][]string{
+		// A record cached by another process is used without a lookup.
+		"shared.example.com": {"v=spf1 +all"},
+	}}
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":        {"v=spf1 -all"},
+		"shared.example.com": {"v=spf1 -all"},
+	})
+	sc.Cache = cache
+
+	res, err := sc.ValidateResult("192.0.2.1", "shared.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&f.queries))
+
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries))
+	assert.Equal(t, []string{"v=spf1 -all"}, cache.records["example.com"])
+
+	sc.DumpCache()
+	assert.Empty(t, cache.records)
+
+	// Without a cache, every check looks the records up.
+	sc.Cache = nil
+	for i := 2; i <= 3; i++ {
+		res, err = sc.ValidateResult("192.0.2.1", "shared.example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, Fail, res)
+		assert.EqualValues(t, i, atomic.LoadInt32(&f.queries))
+	}
+	sc.DumpCache()
+}
+
+func TestNegativeCache(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	f := &fakeResolver{txt: map[string][]string{"other.example.com": {"google-site-verification=abc"}}}
+	sc := NewSPFCheckerWithTTL(time.Hour)
+	sc.resolver = f
+	check := func(domain string, expected error, queries int32) {
+		_, err := sc.LookupRecord(domain)
+		assert.Equal(t, expected, err, domain)
+		assert.Equal(t, queries, atomic.LoadInt32(&f.queries), domain)
+	}
+	// Both kinds of missing record are remembered, for five minutes.
+	check("example.com", ErrNoTXTRecords, 1)
+	check("example.com", ErrNoTXTRecords, 1)
+	check("other.example.com", ErrNoSPFRecordInTXT, 2)
+	check("other.example.com", ErrNoSPFRecordInTXT, 2)
+	f.txt["example.com"] = []string{"v=spf1 -all"}
+	clock = clock.Add(4 * time.Minute)
+	check("example.com", ErrNoTXTRecords, 2)
+	clock = clock.Add(time.Minute)
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&f.queries))
+
+	sc.NegativeTTL = time.Minute
+	check("missing.example.com", ErrNoTXTRecords, 4)
+	clock = clock.Add(time.Minute)
+	check("missing.example.com", ErrNoTXTRecords, 5)
+	sc.DumpCache()
+	check("missing.example.com", ErrNoTXTRecords, 6)
+
+	// A negative NegativeTTL, or no cache at all, remembers nothing.
+	sc.NegativeTTL = -1
+	check("none.example.com", ErrNoTXTRecords, 7)
+	check("none.example.com", ErrNoTXTRecords, 8)
+	sc.NegativeTTL = 0
+	sc.Cache = nil
+	check("none.example.com", ErrNoTXTRecords, 9)
+	check("none.example.com", ErrNoTXTRecords, 10)
+}
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	sc, _ := fakeChecker(map[string][]string{})
+	sc.NegativeTTL = time.Minute
+	assert.Equal(t, defaultNegativeCapacity, sc.negative.capacity)
+	for i := 0; i < 100; i++ {
+		_, err := sc.LookupRecord(fmt.Sprintf("%d.example.com", i))
+		assert.Equal(t, ErrNoTXTRecords, err)
+	}
+	assert.Equal(t, 100, sc.negative.lru.Len())
+
+	// Expired entries are removed as others are added, or when asked for.
+	clock = clock.Add(time.Minute)
+	sc.LookupRecord("0.example.com")
+	assert.Equal(t, 1, sc.negative.lru.Len())
+	clock = clock.Add(time.Minute)
+	sc.negative.get("0.example.com")
+	assert.Equal(t, 0, sc.negative.lru.Len())
+	assert.Equal(t, 0, len(sc.negative.entries))
+
+	// Nor are more remembered than the capacity allows.
+	sc.negative = newMemoryCache(0, 10)
+	for i := 0; i < 100; i++ {
+		sc.LookupRecord(fmt.Sprintf("%d.example.com", i))
+	}
+	assert.Equal(t, 10, sc.negative.lru.Len())
+}
+
+func TestWarmCache(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"a.example.com": {"v=spf1 -all"},
+		"b.example.com": {"v=spf1 +all"},
+		"c.example.com": {"v=spf1 -all"},
+	})
+	f.fail = map[string]error{"broken.example.com": &net.DNSError{Err: "server misbehaving", Name: "broken.example.com", IsTemporary: true}}
+
+	err := sc.WarmCache(context.Background(), []string{"a.example.com", "b.example.com", "broken.example.com", "c.example.com", "missing.example.com"})
+	assert.True(t, errors.Is(err, ErrNoTXTRecords))
+	assert.Contains(t, err.Error(), "missing.example.com: ")
+	assert.Contains(t, err.Error(), "broken.example.com: lookup broken.example.com: server misbehaving")
+	assert.EqualValues(t, 5, atomic.LoadInt32(&f.queries))
+
+	// The domains that were warmed are checked without further lookups.
+	for domain, expected := range map[string]Result{"a.example.com": Fail, "b.example.com": Pass, "c.example.com": Fail} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, domain)
+	}
+	assert.EqualValues(t, 5, atomic.LoadInt32(&f.queries))
+
+	assert.Nil(t, sc.WarmCache(context.Background(), []string{"a.example.com"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = sc.WarmCache(ctx, []string{"d.example.com", "e.example.com"})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestInvalidateDomain(t *testing.T) {
+	f := &fakeResolver{txt: map[string][]string{
+		"a.example.com": {"v=spf1 -all"},
+		"b.example.com": {"v=spf1 -all"},
+	}}
+	sc := NewSPFCheckerWithCapacity(2)
+	sc.resolver = f
+	check := func(domain string, expected Result, queries int32) {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, domain)
+		assert.Equal(t, queries, atomic.LoadInt32(&f.queries), domain)
+	}
+	check("a.example.com", Fail, 1)
+	check("b.example.com", Fail, 2)
+	check("c.example.com", None, 3)
+
+	// Only the invalidated domains are looked up again.
+	f.txt["a.example.com"] = []string{"v=spf1 +all"}
+	f.txt["c.example.com"] = []string{"v=spf1 +all"}
+	sc.InvalidateDomain("a.example.com.")
+	sc.InvalidateDomain("c.example.com")
+	check("a.example.com", Pass, 4)
+	check("b.example.com", Fail, 4)
+	check("c.example.com", Pass, 5)
+	assert.Equal(t, 2, sc.Cache.(*memoryCache).lru.Len())
+
+	sc.InvalidateDomain("missing.example.com")
+	sc.Cache = nil
+	sc.InvalidateDomain("a.example.com")
+}
+
+func TestNoCache(t *testing.T) {
+	f := &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 -all"}}}
+	sc := NewSPFCheckerNoCache()
+	sc.resolver = f
+	for i := int32(1); i <= 3; i++ {
+		res, err := sc.ValidateResult("192.0.2.1", "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, Fail, res)
+		_, err = sc.LookupRecord("missing.example.com")
+		assert.Equal(t, ErrNoTXTRecords, err)
+		assert.Equal(t, 2*i, atomic.LoadInt32(&f.queries))
+	}
+	assert.Nil(t, sc.WarmCache(context.Background(), []string{"example.com"}))
+	sc.InvalidateDomain("example.com")
+	sc.DumpCache()
+}
+
+// gatedResolver holds up TXT lookups until release is closed, having
+// signalled each on started with a channel that releases it alone.
+type gatedResolver struct {
+	Resolver
+	started chan chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	release := make(chan struct{})
+	g.started <- release
+	select {
+	case <-release:
+	case <-g.release:
+	}
+	return g.Resolver.LookupTXT(ctx, name)
+}
+
+func TestDumpCacheInFlight(t *testing.T) {
+	f := &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 -all"}}}
+	for _, dump := range []func(sc *Checker){
+		(*Checker).DumpCache,
+		func(sc *Checker) { sc.InvalidateDomain("example.com") },
+	} {
+		g := &gatedResolver{f, make(chan chan struct{}, 2), make(chan struct{})}
+		sc := NewSPFCheckerWithResolver(g)
+		results := make(chan Result, 2)
+		for _, domain := range []string{"example.com", "missing.example.com"} {
+			go func() {
+				res, _ := sc.ValidateResult("192.0.2.1", domain)
+				results <- res
+			}()
+		}
+		<-g.started
+		<-g.started
+		dump(sc)
+		close(g.release)
+		// The checks in flight use what they looked up, without caching
+		// it over the dump.
+		assert.ElementsMatch(t, []Result{Fail, None}, []Result{<-results, <-results})
+		for _, domain := range []string{"example.com", "missing.example.com"} {
+			_, _, ok, _ := sc.cached(domain)
+			assert.False(t, ok, domain)
+		}
+
+		// Lookups that start after the dump are cached as ever.
+		g.started = make(chan chan struct{}, 1)
+		res, err := sc.ValidateResult("192.0.2.1", "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, Fail, res)
+		_, _, ok, _ := sc.cached("example.com")
+		assert.True(t, ok)
+	}
+}
+
+// missSignal signals each cache miss on missed, as a check is about to
+// make or join a lookup.
+type missSignal struct {
+	*countingMetrics
+	missed chan struct{}
+}
+
+func (m *missSignal) CacheMiss() {
+	m.countingMetrics.CacheMiss()
+	m.missed <- struct{}{}
+}
+
+func TestSharedLookups(t *testing.T) {
+	f := &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 -all"}}}
+	g := &gatedResolver{f, make(chan chan struct{}, 10), make(chan struct{})}
+	sc := NewSPFCheckerWithResolver(g)
+	m := &missSignal{newCountingMetrics(), make(chan struct{}, 10)}
+	sc.Metrics = m
+	var wg sync.WaitGroup
+	check := func(ctx context.Context, expected Result) {
+		defer wg.Done()
+		res, _ := sc.ValidateContext(ctx, "192.0.2.1", "example.com")
+		assert.Equal(t, expected, res)
+	}
+	wg.Add(1)
+	go check(context.Background(), Fail)
+	<-g.started
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go check(context.Background(), Fail)
+	}
+	// The lookup is held up until every check has missed the cache.
+	for i := 0; i < 10; i++ {
+		<-m.missed
+	}
+	close(g.release)
+	wg.Wait()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries), "the checks share a lookup")
+
+	// A check whose lookup is shared still gets its records if the check
+	// that made it gives up.
+	f.queries = 0
+	g.release = make(chan struct{})
+	sc.DumpCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(2)
+	go check(ctx, TempError)
+	<-g.started
+	<-m.missed
+	go check(context.Background(), Fail)
+	<-m.missed
+	cancel()
+	close(g.release)
+	wg.Wait()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.queries))
+}
+
+func TestSharedLookupsInvalidated(t *testing.T) {
+	f := &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 -all"}}}
+	g := &gatedResolver{f, make(chan chan struct{}, 2), make(chan struct{})}
+	sc := NewSPFCheckerWithResolver(g)
+	results := make(chan Result)
+	check := func() {
+		res, _ := sc.ValidateResult("192.0.2.1", "example.com")
+		results <- res
+	}
+	go check()
+	before := <-g.started
+	sc.InvalidateDomain("example.com")
+
+	// A check after the invalidation makes its own lookup, rather than
+	// waiting on one that may have fetched the old record.
+	go check()
+	var after chan struct{}
+	select {
+	case after = <-g.started:
+	case <-time.After(time.Second):
+		t.Fatal("the check joined a lookup from before the invalidation")
+	}
+	close(before)
+	assert.Equal(t, Fail, <-results)
+	f.txt["example.com"] = []string{"v=spf1 +all"}
+	close(after)
+	assert.Equal(t, Pass, <-results)
+
+	close(g.release)
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.queries))
+}
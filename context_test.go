@@ -0,0 +1,61 @@
+package spf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateContextCancelled(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 include:slow.example.com -all"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := sc.ValidateContext(ctx, "192.0.2.1", "example.com")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, TempError, res)
+	assert.EqualValues(t, 0, f.queries, "no lookups after the context is done")
+
+	f.hang["slow.example.com"] = true
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res, err = sc.ValidateContext(ctx, "192.0.2.1", "example.com")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, TempError, res)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestMaxEvalDuration(t *testing.T) {
+	// Each include is only looked up once the record naming it has been,
+	// so the lookups cannot overlap.
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":   {"v=spf1 include:1.example.com -all"},
+		"1.example.com": {"v=spf1 include:2.example.com -all"},
+		"2.example.com": {"v=spf1 include:3.example.com -all"},
+		"3.example.com": {"v=spf1 include:4.example.com -all"},
+		"4.example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+	})
+	f.latency = 50 * time.Millisecond
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	// A lookup that never returns is given up on.
+	sc.DumpCache()
+	sc.MaxEvalDuration = 75 * time.Millisecond
+	f.hang["3.example.com"] = true
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, TempError, res)
+
+	// The limit is on the whole check, not on each lookup.
+	delete(f.hang, "3.example.com")
+	sc.DumpCache()
+	res, err = sc.ValidateRecord("192.0.2.1", "example.com", "v=spf1 include:1.example.com -all")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, TempError, res)
+}
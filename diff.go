@@ -0,0 +1,46 @@
+package spf
+
+// DiffEntry is an IP whose result changes between two records.
+type DiffEntry struct {
+	IP  string
+	Old Result
+	New Result
+	// OldErr and NewErr are the errors accompanying the results, which
+	// are set for TempError and PermError.
+	OldErr error
+	NewErr error
+}
+
+// Diff compares two records using the built-in SPF Checker; see
+// Checker.Diff.
+func Diff(oldRecord, newRecord, domain string, ips []string) ([]DiffEntry, error) {
+	return looker.Diff(oldRecord, newRecord, domain, ips)
+}
+
+// Diff checks each of ips against two records for a domain, as
+// ValidateRecord does, and returns those whose result differs, in the
+// order given, so that a change to a record can be checked against the
+// known senders before it is published. Records that cannot be parsed and
+// IPs that are invalid are errors, rather than a difference. A TempError on
+// either side is a difference that may not last; its error says why.
+func (sc *Checker) Diff(oldRecord, newRecord, domain string, ips []string) ([]DiffEntry, error) {
+	for _, record := range []string{oldRecord, newRecord} {
+		if _, err := parseRecord(record, !sc.Strict); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		if _, err := parseClientIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	var diffs []DiffEntry
+	for _, ip := range ips {
+		oldRes, oldErr := sc.ValidateRecord(ip, domain, oldRecord)
+		newRes, newErr := sc.ValidateRecord(ip, domain, newRecord)
+		if oldRes != newRes {
+			diffs = append(diffs, DiffEntry{IP: ip, Old: oldRes, New: newRes, OldErr: oldErr, NewErr: newErr})
+		}
+	}
+	return diffs, nil
+}
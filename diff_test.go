@@ -0,0 +1,38 @@
+package spf
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"_spf.example.com": {"v=spf1 ip4:203.0.113.0/24 -all"},
+	})
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	ips := []string{"192.0.2.1", "198.51.100.1", "203.0.113.1", "2001:db8::1"}
+
+	diffs, err := sc.Diff("v=spf1 ip4:192.0.2.0/24 a:mail.example.com ~all",
+		"v=spf1 ip4:192.0.2.0/24 include:_spf.example.com include:missing.example.com -all", "example.com", ips)
+	assert.Nil(t, err)
+	if assert.Len(t, diffs, 3) {
+		assert.Equal(t, DiffEntry{IP: "198.51.100.1", Old: Pass, New: PermError, NewErr: diffs[0].NewErr}, diffs[0])
+		assert.True(t, errors.Is(diffs[0].NewErr, ErrNoSPFRecords))
+		assert.Equal(t, DiffEntry{IP: "203.0.113.1", Old: SoftFail, New: Pass}, diffs[1])
+		assert.Equal(t, "2001:db8::1", diffs[2].IP)
+		assert.Equal(t, SoftFail, diffs[2].Old)
+		assert.Equal(t, PermError, diffs[2].New)
+	}
+
+	diffs, err = sc.Diff("v=spf1 -all", "v=spf1 -all", "example.com", ips)
+	assert.Nil(t, err)
+	assert.Nil(t, diffs)
+
+	_, err = sc.Diff("v=spf1 -all", "v=spf1 ip4:192.0.2.0/33 -all", "example.com", ips)
+	assert.True(t, errors.Is(err, ErrSyntax))
+	_, err = sc.Diff("v=spf1 -all", "v=spf1 +all", "example.com", []string{"192.0.2.1", "bogus"})
+	assert.True(t, errors.Is(err, ErrInvalidIP))
+}
@@ -0,0 +1,285 @@
+package spf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeSPF is the deprecated SPF resource record type of RFC 4408.
+const typeSPF dnsmessage.Type = 99
+
+// maxCNAMEs is the length of the chains of CNAME records that DNSClient
+// follows; longer chains are treated as loops.
+const maxCNAMEs = 8
+
+// maxUDPSize is the size of DNS responses DNSClient accepts over UDP,
+// advertised through EDNS(0).
+const maxUDPSize = 4096
+
+// DNSClient is a Resolver that sends its queries to a single DNS server.
+// Beyond Resolver, it implements SPFTypeResolver, TTLResolver and
+// AuthenticatingResolver, for which the server must validate DNSSEC. Its TXT and SPF lookups
+// follow CNAME records themselves, whether or not the server does.
+type DNSClient struct {
+	// Server is the address of the DNS server, as host:port.
+	Server   string
+	resolver *net.Resolver
+}
+
+// NewDNSClient returns a DNSClient that queries the given server, as
+// host:port.
+func NewDNSClient(server string) *DNSClient {
+	c := &DNSClient{Server: server}
+	c.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, c.Server)
+		},
+	}
+	return c
+}
+
+// LookupTXT returns a name's TXT records, each as the concatenation of its
+// strings.
+func (c *DNSClient) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	a, err := c.lookupStrings(ctx, name, dnsmessage.TypeTXT)
+	return a.records, err
+}
+
+// LookupTXTWithTTL is LookupTXT, along with how long the records may be
+// cached for: the least of their TTLs and those of any CNAME records
+// followed to them.
+func (c *DNSClient) LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	a, err := c.lookupStrings(ctx, name, dnsmessage.TypeTXT)
+	return a.records, a.ttl, err
+}
+
+// LookupTXTAuthenticated is LookupTXT, along with whether the server
+// reported every response leading to the records as authenticated by
+// DNSSEC, through their AD bits. It can only be trusted of a validating
+// server reached over a secure path.
+func (c *DNSClient) LookupTXTAuthenticated(ctx context.Context, name string) ([]string, bool, error) {
+	a, err := c.lookupStrings(ctx, name, dnsmessage.TypeTXT)
+	return a.records, a.authenticated, err
+}
+
+// LookupIPAddr looks up a host's IPv4 and IPv6 addresses through the server.
+func (c *DNSClient) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return c.resolver.LookupIPAddr(ctx, host)
+}
+
+// LookupMX looks up a name's MX records through the server.
+func (c *DNSClient) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return c.resolver.LookupMX(ctx, name)
+}
+
+// LookupAddr looks up the names of an address through the server.
+func (c *DNSClient) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return c.resolver.LookupAddr(ctx, addr)
+}
+
+// LookupSPF returns a domain's SPF (type 99) records, each as the
+// concatenation of its strings.
+func (c *DNSClient) LookupSPF(ctx context.Context, name string) ([]string, error) {
+	a, err := c.lookupStrings(ctx, name, typeSPF)
+	return a.records, err
+}
+
+// stringsAnswer is the records found by lookupStrings, with the least TTL of
+// those records and the CNAME records followed to them, and whether every
+// response they came in was authenticated.
+type stringsAnswer struct {
+	records       []string
+	ttl           time.Duration
+	authenticated bool
+}
+
+// lookupStrings returns a name's records of a TXT-like type, each as the
+// concatenation of its strings. CNAME records are followed through the
+// answers to each query, and queried again where the server left a chain
+// unfinished.
+func (c *DNSClient) lookupStrings(ctx context.Context, name string, qtype dnsmessage.Type) (stringsAnswer, error) {
+	owner := canonicalDomain(name)
+	seen := map[string]bool{owner: true}
+	ttl := uint32(math.MaxUint32)
+	authenticated := true
+	for {
+		queried := owner
+		msg, err := c.exchange(ctx, queried, qtype)
+		if err != nil {
+			return stringsAnswer{}, err
+		}
+		authenticated = authenticated && msg.AuthenticData
+		aliases := make(map[string]dnsmessage.Resource)
+		for _, rr := range msg.Answers {
+			if _, ok := rr.Body.(*dnsmessage.CNAMEResource); ok {
+				aliases[canonicalDomain(rr.Header.Name.String())] = rr
+			}
+		}
+		for alias, ok := aliases[owner]; ok; alias, ok = aliases[owner] {
+			target := canonicalDomain(alias.Body.(*dnsmessage.CNAMEResource).CNAME.String())
+			if seen[target] || len(seen) > maxCNAMEs {
+				return stringsAnswer{}, fmt.Errorf("%w: %s", ErrCNAMELoop, name)
+			}
+			seen[target] = true
+			owner = target
+			ttl = min(ttl, alias.Header.TTL)
+		}
+		var records []string
+		for _, rr := range msg.Answers {
+			if rr.Header.Type != qtype || canonicalDomain(rr.Header.Name.String()) != owner {
+				continue
+			}
+			var record string
+			switch body := rr.Body.(type) {
+			case *dnsmessage.TXTResource:
+				record = strings.Join(body.TXT, "")
+			case *dnsmessage.UnknownResource:
+				if record, err = characterStrings(body.Data); err != nil {
+					return stringsAnswer{}, &net.DNSError{Err: err.Error(), Name: name, Server: c.Server}
+				}
+			default:
+				continue
+			}
+			records = append(records, record)
+			ttl = min(ttl, rr.Header.TTL)
+		}
+		if len(records) > 0 {
+			return stringsAnswer{records, time.Duration(ttl) * time.Second, authenticated}, nil
+		}
+		if owner == queried {
+			return stringsAnswer{}, &net.DNSError{Err: "no such host", Name: name, Server: c.Server, IsNotFound: true}
+		}
+	}
+}
+
+// characterStrings returns the concatenation of the character-strings that
+// make up TXT-like record data.
+func characterStrings(data []byte) (string, error) {
+	var out strings.Builder
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			return "", errors.New("malformed character-string")
+		}
+		out.Write(data[1 : 1+n])
+		data = data[1+n:]
+	}
+	return out.String(), nil
+}
+
+// exchange sends a query to the server and returns its response, over UDP
+// and then, if the response was truncated, over TCP. Error responses are
+// returned as a *net.DNSError.
+func (c *DNSClient) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	query := dnsmessage.Message{
+		// Validating servers only report authentication to clients that
+		// ask for it, per RFC 6840 section 5.7.
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true, AuthenticData: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	query.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	msg, err := c.roundTrip(ctx, "udp", packed)
+	if err == nil && msg.Truncated {
+		msg, err = c.roundTrip(ctx, "tcp", packed)
+	}
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: name, Server: c.Server}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			dnsErr.IsTimeout = true
+		}
+		return nil, dnsErr
+	}
+	if msg.ID != query.ID {
+		return nil, &net.DNSError{Err: "response does not match query", Name: name, Server: c.Server, IsTemporary: true}
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+		return msg, nil
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: c.Server, IsNotFound: true}
+	case dnsmessage.RCodeServerFailure:
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, Server: c.Server, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "server answered " + msg.RCode.String(), Name: name, Server: c.Server}
+}
+
+// roundTrip sends a packed query to the server over the given network and
+// reads its response.
+func (c *DNSClient) roundTrip(ctx context.Context, network string, query []byte) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock the reads below if the context is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var buf []byte
+	if network == "tcp" {
+		framed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		copy(framed[2:], query)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, maxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	msg := new(dnsmessage.Message)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,400 @@
+package spf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer answers DNS queries over UDP and TCP from a table of records by
+// name and type. Answers to names in truncate are truncated over UDP, and
+// those to names in authentic have the AD bit set. The
+// CNAME record of a name without records of the type asked for is answered
+// in their place, along with, if chase is set, the records of its target.
+type dnsServer struct {
+	mu        sync.Mutex
+	records   map[dnsmessage.Question][]dnsmessage.Resource
+	truncate  map[string]bool
+	authentic map[string]bool
+	chase     bool
+	udp       net.PacketConn
+	tcp       net.Listener
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	var udp net.PacketConn
+	var tcp net.Listener
+	var err error
+	// The TCP port of the same number as the UDP one may be taken, in
+	// which case another pair is tried.
+	for i := 0; i < 10; i++ {
+		if udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if tcp, err = net.Listen("tcp", udp.LocalAddr().String()); err == nil {
+			break
+		}
+		udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{
+		records:   make(map[dnsmessage.Question][]dnsmessage.Resource),
+		truncate:  make(map[string]bool),
+		authentic: make(map[string]bool),
+		udp:       udp,
+		tcp:       tcp,
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *dnsServer) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// add adds a record of the given type made of the given strings to the
+// table.
+func (s *dnsServer) add(name string, qtype dnsmessage.Type, text ...string) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+	rr := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: q.Name, Type: qtype, Class: q.Class, TTL: 300}}
+	switch qtype {
+	case dnsmessage.TypeTXT:
+		rr.Body = &dnsmessage.TXTResource{TXT: text}
+	case dnsmessage.TypeCNAME:
+		rr.Body = &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(text[0])}
+	default:
+		var data []byte
+		for _, t := range text {
+			data = append(append(data, byte(len(t))), t...)
+		}
+		rr.Body = &dnsmessage.UnknownResource{Type: qtype, Data: data}
+	}
+	s.mu.Lock()
+	s.records[q] = append(s.records[q], rr)
+	s.mu.Unlock()
+}
+
+// setTTL sets the TTL of a name's records of the given type.
+func (s *dnsServer) setTTL(name string, qtype dnsmessage.Type, ttl uint32) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+	s.mu.Lock()
+	for i := range s.records[q] {
+		s.records[q][i].Header.TTL = ttl
+	}
+	s.mu.Unlock()
+}
+
+func (s *dnsServer) answer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RecursionAvailable: true},
+		Questions: msg.Questions,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exists := false
+	for known := range s.records {
+		exists = exists || strings.EqualFold(known.Name.String(), q.Name.String())
+	}
+	if !exists {
+		resp.RCode = dnsmessage.RCodeNameError
+	} else if udp && s.truncate[q.Name.String()] {
+		resp.Truncated = true
+	} else {
+		resp.Answers = s.lookup(q)
+		resp.AuthenticData = s.authentic[q.Name.String()]
+	}
+	packed, _ := resp.Pack()
+	return packed
+}
+
+// lookup returns the answers to a question, following CNAME records as far
+// as the server does.
+func (s *dnsServer) lookup(q dnsmessage.Question) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	for len(answers) <= maxCNAMEs {
+		if rrs := s.records[q]; len(rrs) > 0 {
+			return append(answers, rrs...)
+		}
+		alias := s.records[dnsmessage.Question{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: q.Class}]
+		if len(alias) == 0 {
+			break
+		}
+		answers = append(answers, alias[0])
+		if !s.chase {
+			break
+		}
+		q.Name = alias[0].Body.(*dnsmessage.CNAMEResource).CNAME
+	}
+	return answers
+}
+
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.udp.WriteTo(s.answer(buf[:n], true), addr)
+	}
+}
+
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.answer(query, false)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}
+		}()
+	}
+}
+
+func TestDNSClientLookupSPF(t *testing.T) {
+	s := newDNSServer(t)
+	s.add("example.com.", typeSPF, "v=spf1 -all")
+	s.add("big.example.com.", typeSPF, "v=spf1 +all")
+	s.add("txt.example.com.", dnsmessage.TypeTXT, "v=spf1 ?all")
+	s.mu.Lock()
+	s.truncate["big.example.com."] = true
+	s.mu.Unlock()
+	c := NewDNSClient(s.addr())
+
+	records, err := c.LookupSPF(context.Background(), "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=spf1 -all"}, records)
+
+	// Truncated answers are fetched again over TCP.
+	records, err = c.LookupSPF(context.Background(), "big.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=spf1 +all"}, records)
+
+	for _, name := range []string{"txt.example.com", "missing.example.com"} {
+		_, err = c.LookupSPF(context.Background(), name)
+		assert.True(t, isNotFound(err), "%s: %v", name, err)
+	}
+}
+
+func TestQuerySPFType(t *testing.T) {
+	s := newDNSServer(t)
+	s.add("legacy.example.com.", typeSPF, "v=spf1 ip4:192.0.2.0/24 -all")
+	s.add("legacy.example.com.", dnsmessage.TypeTXT, "v=spf1 -all")
+	s.add("txt.example.com.", dnsmessage.TypeTXT, "v=spf1 ip4:192.0.2.0/24 -all")
+	s.add("include.example.com.", dnsmessage.TypeTXT, "v=spf1 include:legacy.example.com -all")
+
+	sc := NewSPFCheckerWithResolver(NewDNSClient(s.addr()))
+	sc.QuerySPFType = true
+	for _, domain := range []string{"legacy.example.com", "txt.example.com", "include.example.com"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, Pass, res, domain)
+	}
+
+	// By default only TXT records are used.
+	sc = NewSPFCheckerWithResolver(NewDNSClient(s.addr()))
+	res, err := sc.ValidateResult("192.0.2.1", "legacy.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+}
+
+func TestSplitRecords(t *testing.T) {
+	s := newDNSServer(t)
+	// A record longer than a single string is published as several.
+	s.add("example.com.", dnsmessage.TypeTXT, "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 ip4:203.0.113.0/24 ",
+		"ip6:2001:db8::/32 -all")
+	s.add("example.com.", dnsmessage.TypeTXT, "google-site-verification=abc")
+	s.add("legacy.example.com.", typeSPF, "v=spf1 ip4:192.0.2.0/24", " -all")
+	// Separate records are never joined, even where one looks like the end
+	// of another.
+	s.add("separate.example.com.", dnsmessage.TypeTXT, "v=spf1 ip4:192.0.2.0/24")
+	s.add("separate.example.com.", dnsmessage.TypeTXT, " -all")
+
+	sc := NewSPFCheckerWithResolver(NewDNSClient(s.addr()))
+	sc.QuerySPFType = true
+	record, err := sc.LookupRecord("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 ip4:203.0.113.0/24 ip6:2001:db8::/32 -all", record)
+	record, err = sc.LookupRecord("legacy.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 ip4:192.0.2.0/24 -all", record)
+	record, err = sc.LookupRecord("separate.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 ip4:192.0.2.0/24", record)
+
+	// The whole of each record is evaluated, up to its end.
+	for domain, expected := range map[string]Result{
+		"example.com":          Pass,
+		"legacy.example.com":   Fail,
+		"separate.example.com": Neutral,
+	} {
+		res, err := sc.ValidateResult("2001:db8:ffff::1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, domain)
+	}
+}
+
+func TestDNSClientCNAME(t *testing.T) {
+	s := newDNSServer(t)
+	s.add("example.com.", dnsmessage.TypeTXT, "v=spf1 include:alias.example.com -all")
+	s.add("alias.example.com.", dnsmessage.TypeCNAME, "Other.Example.com.")
+	s.add("other.example.com.", dnsmessage.TypeCNAME, "spf.example.net.")
+	s.add("spf.example.net.", dnsmessage.TypeTXT, "v=spf1 ip4:192.0.2.0/24 -all")
+	s.add("looping.example.com.", dnsmessage.TypeTXT, "v=spf1 include:loop.example.com -all")
+	s.add("loop.example.com.", dnsmessage.TypeCNAME, "loop2.example.com.")
+	s.add("loop2.example.com.", dnsmessage.TypeCNAME, "loop.example.com.")
+	s.add("dangling.example.com.", dnsmessage.TypeTXT, "v=spf1 include:missing.example.com -all")
+	s.add("missing.example.com.", dnsmessage.TypeCNAME, "nowhere.example.net.")
+
+	// Chains are followed whether the server follows them or not.
+	for _, chase := range []bool{false, true} {
+		s.mu.Lock()
+		s.chase = chase
+		s.mu.Unlock()
+		c := NewDNSClient(s.addr())
+
+		records, err := c.LookupTXT(context.Background(), "alias.example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"v=spf1 ip4:192.0.2.0/24 -all"}, records)
+		_, err = c.LookupTXT(context.Background(), "loop.example.com")
+		assert.True(t, errors.Is(err, ErrCNAMELoop), "chase=%v: %v", chase, err)
+		_, err = c.LookupTXT(context.Background(), "missing.example.com")
+		assert.True(t, isNotFound(err), "chase=%v: %v", chase, err)
+
+		sc := NewSPFCheckerWithResolver(c)
+		for domain, expected := range map[string]Result{
+			"example.com":          Pass,
+			"alias.example.com":    Pass,
+			"looping.example.com":  PermError,
+			"loop.example.com":     PermError,
+			"dangling.example.com": PermError,
+		} {
+			res, _ := sc.ValidateResult("192.0.2.1", domain)
+			assert.Equal(t, expected, res, "chase=%v: %s", chase, domain)
+		}
+	}
+}
+
+func TestLookupRecordWithTTL(t *testing.T) {
+	s := newDNSServer(t)
+	s.add("example.com.", dnsmessage.TypeTXT, "v=spf1 -all")
+	s.add("example.com.", dnsmessage.TypeTXT, "google-site-verification=abc")
+	s.setTTL("example.com.", dnsmessage.TypeTXT, 3600)
+	s.add("alias.example.com.", dnsmessage.TypeCNAME, "example.com.")
+	s.setTTL("alias.example.com.", dnsmessage.TypeCNAME, 60)
+	s.add("other.example.com.", dnsmessage.TypeTXT, "google-site-verification=abc")
+
+	sc := NewSPFCheckerWithResolver(NewDNSClient(s.addr()))
+	record, ttl, err := sc.LookupRecordWithTTL("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 -all", record)
+	assert.Equal(t, time.Hour, ttl)
+	// An alias may be cached for no longer than its CNAME record.
+	record, ttl, err = sc.LookupRecordWithTTL("alias.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 -all", record)
+	assert.Equal(t, time.Minute, ttl)
+
+	// The record is looked up afresh each time.
+	s.setTTL("example.com.", dnsmessage.TypeTXT, 30)
+	_, ttl, err = sc.LookupRecordWithTTL("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	_, _, err = sc.LookupRecordWithTTL("other.example.com")
+	assert.Equal(t, ErrNoSPFRecordInTXT, err)
+	_, _, err = sc.LookupRecordWithTTL("missing.example.com")
+	assert.Equal(t, ErrNoTXTRecords, err)
+
+	_, _, err = NewSPFChecker().LookupRecordWithTTL("example.com")
+	assert.Equal(t, ErrNoTTLs, err)
+}
+
+func TestDNSSECStatus(t *testing.T) {
+	s := newDNSServer(t)
+	s.add("example.com.", dnsmessage.TypeTXT, "v=spf1 include:_spf.example.com -all")
+	s.add("_spf.example.com.", dnsmessage.TypeTXT, "v=spf1 ip4:192.0.2.0/24 -all")
+	s.add("partial.example.com.", dnsmessage.TypeTXT, "v=spf1 include:_spf.example.net -all")
+	s.add("_spf.example.net.", dnsmessage.TypeTXT, "v=spf1 ip4:192.0.2.0/24 -all")
+	s.add("alias.example.com.", dnsmessage.TypeCNAME, "_spf.example.net.")
+	s.mu.Lock()
+	for _, name := range []string{"example.com.", "_spf.example.com.", "partial.example.com.", "alias.example.com."} {
+		s.authentic[name] = true
+	}
+	s.mu.Unlock()
+
+	sc := NewSPFCheckerWithResolver(NewDNSClient(s.addr()))
+	for domain, expected := range map[string]DNSSECStatus{
+		"example.com":         DNSSECValidated,
+		"partial.example.com": DNSSECNotValidated,
+		"_spf.example.net":    DNSSECNotValidated,
+	} {
+		// The status is kept with cached records.
+		for i := 0; i < 2; i++ {
+			ev, err := sc.Check("192.0.2.1", domain)
+			assert.Nil(t, err)
+			assert.Equal(t, Pass, ev.Result, domain)
+			assert.Equal(t, expected, ev.DNSSEC, domain)
+		}
+	}
+	// Every response in a chain of CNAME records must be authenticated.
+	_, authenticated, err := NewDNSClient(s.addr()).LookupTXTAuthenticated(context.Background(), "alias.example.com")
+	assert.Nil(t, err)
+	assert.False(t, authenticated)
+
+	// Records from other caches, and other Resolvers, have no status.
+	sc.Cache = &mapCache{records: map[string][]string{}}
+	ev, err := sc.Check("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECValidated, ev.DNSSEC)
+	ev, err = sc.Check("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECUnknown, ev.DNSSEC)
+	fake, _ := fakeChecker(map[string][]string{"example.com": {"v=spf1 -all"}})
+	ev, err = fake.Check("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECUnknown, ev.DNSSEC)
+
+	// Nor do records that did not come through DNS, even where what they
+	// include did, authenticated.
+	rec, err := ParseRecord("v=spf1 include:_spf.example.com -all")
+	assert.Nil(t, err)
+	ev, err = Evaluate(context.Background(), NewDNSClient(s.addr()), rec, net.ParseIP("192.0.2.1"), "example.com", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, ev.Result)
+	assert.Equal(t, DNSSECUnknown, ev.DNSSEC)
+}
@@ -19,16 +19,62 @@ func TestEmailParsing(t *testing.T) {
   gdfe(t, "garvey.me", "Cathal <cathal@garvey.me>")
   gdfe(t, "garvey.me", "Cathal <cathalGarvey@garvey.me>")
   gdfe(t, "garvey.me", "cathal@Garvey.Me")
+  gdfe(t, "garvey.me", "cathal@garvey.me.")
+  gdfe(t, "garvey.me", "Cathal <cathal@garvey.me.>")
+  gdfe(t, "xn--bcher-kva.example", "user@Bücher.example")
+  gdfe(t, "xn--bcher-kva.example", "user@xn--bcher-kva.example")
+  gdfe(t, "xn--eckwd4c7c.xn--bcher-kva.example", "ユーザー@ドメイン.bücher.example")
+}
+
+func TestTrickyEmailParsing(t *testing.T) {
+  // Quoted local parts may hold @s of their own.
+  gdfe(t, "example.com", `"odd@user"@example.com`)
+  gdfe(t, "example.com", `"Odd, User" <odd@example.com>`)
+  // A group of one address is that address.
+  gdfe(t, "example.com", "Team: alice@example.com;")
+  // Display names that net/mail rejects still leave the address.
+  gdfe(t, "example.com", "Garvey, Cathal <cathal@example.com>")
+  gdfe(t, "example.com", "Cathal J. Garvey <cathal@example.com>")
+  gdfe(t, "example.com", "<cathal@example.com>")
+
+  for _, eml := range []string{
+    "alice@example.com, bob@example.com",
+    "Alice <alice@example.com>, bob@example.com",
+    "Team: alice@example.com, bob@example.com;",
+    "Team:;",
+  } {
+    _, err := GetDomainFromEmail(eml)
+    assert.Equal(t, ErrMultipleAddresses, err, eml)
+  }
+  for _, eml := range []string{"alice", "alice@", "@example.com", "Name <alice@>", "alice@example.com, broken", "<alice@exa mple.com>"} {
+    _, err := GetDomainFromEmail(eml)
+    assert.NotNil(t, err, eml)
+  }
+}
+
+func TestNullSender(t *testing.T) {
+  for _, eml := range []string{"", "<>", " <> "} {
+    _, err := GetDomainFromEmail(eml)
+    assert.Equal(t, ErrNullSender, err)
+  }
 }
 
 func TestSPFRecords(t *testing.T) {
-  ip := "93.95.224.70"  // mail.1984.is
+  sc, _ := fakeChecker(map[string][]string{
+    "vulpinedesigns.co.uk": {"v=spf1 include:_spf.example.net ~all"},
+    "_spf.example.net":     {"v=spf1 ip4:192.0.2.0/24 -all"},
+    "cathalgarvey.me":      {"google-site-verification=abc"},
+  })
+  ip := "93.95.224.70"
   // vulpinedesigns.co.uk has an SPF record set
-  ok, err := Validate(ip, "vulpinedesigns.co.uk")
+  ok, err := sc.Validate(ip, "vulpinedesigns.co.uk")
   assert.Nil(t, err)
   assert.False(t, ok)
+  ok, err = sc.Validate("192.0.2.1", "vulpinedesigns.co.uk")
+  assert.Nil(t, err)
+  assert.True(t, ok)
   // cathalgarvey.me has no SPF record set
-  ok, err = Validate(ip, "cathalgarvey.me")
+  ok, err = sc.Validate(ip, "cathalgarvey.me")
   assert.Nil(t, err)
   assert.True(t, ok)
 }
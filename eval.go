@@ -0,0 +1,698 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxLookups is the number of terms requiring DNS lookups that a check may
+// evaluate, per RFC 7208 section 4.6.4.
+const maxLookups = 10
+
+// maxVoidLookups is the number of DNS lookups that may find nothing before
+// a check is abandoned, per RFC 7208 section 4.6.4.
+const maxVoidLookups = 2
+
+// defaultMaxDepth is the number of includes and redirects a check may nest
+// by default. The lookup limit never allows more.
+const defaultMaxDepth = maxLookups
+
+// The errors that make an evaluation a PermError, which the errors returned
+// for it match with errors.Is.
+var (
+	// ErrTooManyLookups when a check needs more than 10 DNS lookups.
+	ErrTooManyLookups = errors.New("too many DNS lookups")
+	// ErrTooManyVoidLookups when more than 2 lookups find nothing.
+	ErrTooManyVoidLookups = errors.New("too many DNS lookups found nothing")
+	// ErrTooManyMXRecords when an mx mechanism's domain has more than 10
+	// MX records.
+	ErrTooManyMXRecords = errors.New("too many MX records")
+	// ErrTooManyMXAddresses when one of an mx mechanism's MX hosts has
+	// more than 10 addresses.
+	ErrTooManyMXAddresses = errors.New("too many addresses for an MX host")
+	// ErrTooDeep when includes and redirects nest deeper than MaxDepth.
+	ErrTooDeep = errors.New("includes and redirects nested too deeply")
+	// ErrLoop when a record includes or redirects to itself.
+	ErrLoop = errors.New("record includes itself")
+	// ErrUntrustedInclude when, with Checker.AllowedIncludes and Strict
+	// set, a record includes that of a domain outside them.
+	ErrUntrustedInclude = errors.New("include of a domain not allowed")
+)
+
+// evaluator carries the state of a single SPF check through the records it
+// visits.
+type evaluator struct {
+	ctx context.Context
+	dns *prefetcher
+	ip  net.IP
+	// sender is the identity being checked, as local-part@domain.
+	sender string
+	helo   string
+	// spfType is set to look for records of the SPF type before TXT ones.
+	spfType bool
+	// strict is set to reject records with unknown mechanisms, rather
+	// than ignore those mechanisms.
+	strict bool
+	// multiple is how domains with more than one SPF record are treated.
+	multiple MultipleRecordPolicy
+	// allowedIncludes, if set, are the domains that may be included, with
+	// their subdomains; warnings describe the includes of others.
+	allowedIncludes []string
+	// softFailAsFail makes the checked domain's SoftFails Fails, with the
+	// explanation of one.
+	softFailAsFail bool
+	warnings       []string
+	tracer         Tracer
+	// maxDepth is the number of includes and redirects that may be nested.
+	maxDepth int
+	// lookups counts the terms evaluated so far that required DNS lookups,
+	// and voids those lookups that found nothing.
+	lookups int
+	voids   int
+	// visiting holds the domains whose records are being evaluated, from
+	// the checked domain down through includes and redirects, so that
+	// loops between them are caught. unmatched holds the include targets
+	// already found not to match.
+	visiting  map[string]bool
+	unmatched map[string]bool
+	// including counts the include mechanisms being evaluated; the
+	// explanations of included records are never used.
+	including int
+	// path holds the include and redirect terms leading to the record being
+	// evaluated. matched is the mechanism that decided the result in the
+	// checked domain's record, or that of its redirect target, and trace
+	// the terms leading to the mechanism that matched within it.
+	path    []string
+	matched string
+	trace   []string
+	// evaluated is the domain whose record is evaluated in place of the
+	// checked domain's, once any redirects are followed, and tried the
+	// mechanisms of that record and those redirecting to it that did not
+	// match.
+	evaluated string
+	tried     []string
+	// dnssec is the DNSSEC status of the records looked up for includes
+	// and redirects.
+	dnssec DNSSECStatus
+}
+
+// newEvaluator returns an evaluator for a check on behalf of a sender, which
+// introduced itself with the given HELO identity, making its lookups through
+// dns.
+func newEvaluator(ctx context.Context, dns *prefetcher, ip net.IP, sender, helo string) *evaluator {
+	return &evaluator{
+		ctx:       ctx,
+		dns:       dns,
+		ip:        ip,
+		sender:    sender,
+		helo:      helo,
+		maxDepth:  defaultMaxDepth,
+		dnssec:    DNSSECValidated,
+		visiting:  make(map[string]bool),
+		unmatched: make(map[string]bool),
+	}
+}
+
+// useLookup counts a term requiring DNS lookups against the limit.
+func (e *evaluator) useLookup() error {
+	e.lookups++
+	if e.tracer != nil {
+		e.tracer.LookupCount(e.lookups)
+	}
+	if e.lookups > maxLookups {
+		return permError{ErrTooManyLookups}
+	}
+	return nil
+}
+
+// useVoidLookup counts a lookup that found nothing against the limit.
+func (e *evaluator) useVoidLookup() error {
+	e.voids++
+	if e.voids > maxVoidLookups {
+		return permError{ErrTooManyVoidLookups}
+	}
+	return nil
+}
+
+// lookupIP returns the addresses of a host.
+func (e *evaluator) lookupIP(host string) ([]net.IP, error) {
+	addrs, err := e.dns.LookupIPAddr(e.ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// enter marks a domain's record as being evaluated. It is a PermError for a
+// record to be reached again from within itself.
+func (e *evaluator) enter(domain string) error {
+	if err := e.checkLoop(domain); err != nil {
+		return err
+	}
+	e.visiting[canonicalDomain(domain)] = true
+	return nil
+}
+
+// checkLoop returns a PermError if a domain's record is being evaluated.
+func (e *evaluator) checkLoop(domain string) error {
+	if e.visiting[canonicalDomain(domain)] {
+		return permError{fmt.Errorf("%s: %w", canonicalDomain(domain), ErrLoop)}
+	}
+	return nil
+}
+
+// leave marks a domain's record as no longer being evaluated.
+func (e *evaluator) leave(domain string) {
+	delete(e.visiting, canonicalDomain(domain))
+}
+
+// checkInclude checks the target of an include in a domain's record
+// against allowedIncludes, giving a PermError for one outside them in
+// strict mode and otherwise a warning. The includes of allowed domains'
+// own records are theirs to vouch for.
+func (e *evaluator) checkInclude(domain, target string) error {
+	if e.allowedIncludes == nil || e.allowedInclude(domain) || e.allowedInclude(target) {
+		return nil
+	}
+	if e.strict {
+		return permError{fmt.Errorf("%s: %w", canonicalDomain(target), ErrUntrustedInclude)}
+	}
+	warning := fmt.Sprintf("%s: include:%s is not of an allowed domain", domain, target)
+	for _, w := range e.warnings {
+		if w == warning {
+			return nil
+		}
+	}
+	e.warnings = append(e.warnings, warning)
+	return nil
+}
+
+// allowedInclude reports whether a domain is one of allowedIncludes or a
+// subdomain of one.
+func (e *evaluator) allowedInclude(domain string) bool {
+	domain = canonicalDomain(domain)
+	for _, allowed := range e.allowedIncludes {
+		allowed = canonicalDomain(allowed)
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalDomain returns the form of a domain name used to compare it.
+func canonicalDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// isNotFound reports whether an error is a DNS lookup finding no records.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// checkHost evaluates a domain's SPF record. Each mechanism is checked in
+// turn, and the first to match decides the result. If none match, the record
+// named by any redirect modifier is evaluated in its place, and otherwise the
+// result is Neutral.
+// For a Fail outside of an include, the explanation published through the
+// deciding record's exp modifier is also returned.
+func (e *evaluator) checkHost(domain string, rec *Record) (Result, string, error) {
+	if err := e.enter(domain); err != nil {
+		return PermError, "", err
+	}
+	defer e.leave(domain)
+	if len(e.path) > e.maxDepth {
+		return PermError, "", permError{ErrTooDeep}
+	}
+	if e.including == 0 {
+		e.evaluated = domain
+	}
+	e.prefetch(domain, rec)
+	for _, m := range rec.Mechanisms {
+		if err := e.ctx.Err(); err != nil {
+			return TempError, "", err
+		}
+		if m.Kind == "include" {
+			e.path = append(e.path, m.String())
+		}
+		matched, err := e.matchMechanism(domain, m)
+		if m.Kind == "include" {
+			e.path = e.path[:len(e.path)-1]
+		}
+		if e.tracer != nil {
+			e.tracer.Mechanism(domain, m.String(), matched, err)
+		}
+		if err != nil {
+			return resultForError(err), "", err
+		}
+		if !matched {
+			if e.including == 0 {
+				e.tried = append(e.tried, m.String())
+			}
+			continue
+		}
+		// A matching include has left the trace of the mechanism that
+		// matched within it.
+		if m.Kind != "include" {
+			e.trace = append(append([]string(nil), e.path...), m.String())
+		}
+		if e.including == 0 {
+			e.matched = m.String()
+		}
+		result := m.Qualifier.Result()
+		if result == SoftFail && e.softFailAsFail && e.including == 0 {
+			result = Fail
+		}
+		if exp, ok := rec.Modifier("exp"); ok && result == Fail && e.including == 0 {
+			return result, e.explain(domain, exp), nil
+		}
+		return result, "", nil
+	}
+	if redirect, ok := rec.Modifier("redirect"); ok {
+		target, err := e.expand(redirect, domain, false)
+		if err != nil {
+			return PermError, "", err
+		}
+		if err := e.useLookup(); err != nil {
+			return PermError, "", err
+		}
+		if err := e.checkLoop(target); err != nil {
+			return PermError, "", err
+		}
+		record, err := e.lookupSPFRecord(target)
+		if err != nil {
+			return resultForError(err), "", fmt.Errorf("redirect to %s: %w", target, err)
+		}
+		targetRec, err := parseRecord(record, !e.strict)
+		if err != nil {
+			return PermError, "", err
+		}
+		if e.tracer != nil {
+			e.tracer.Redirect(domain, target)
+		}
+		e.path = append(e.path, "redirect="+redirect)
+		defer func() { e.path = e.path[:len(e.path)-1] }()
+		return e.checkHost(target, targetRec)
+	}
+	return Neutral, "", nil
+}
+
+// prefetch starts the lookups for the mechanisms of a domain's record, in
+// order, as far as the lookup limit allows, so that they proceed while the
+// record is evaluated.
+func (e *evaluator) prefetch(domain string, rec *Record) {
+	budget := maxLookups - e.lookups
+	for _, m := range rec.Mechanisms {
+		if budget <= 0 {
+			return
+		}
+		switch m.Kind {
+		case "all":
+			// Nothing after all is evaluated, nor any redirect.
+			return
+		case "ip4", "ip6":
+			continue
+		case "ptr":
+			budget--
+			e.dns.prefetch(e.ctx, "ptr", e.ip.String())
+			continue
+		}
+		budget--
+		target := domain
+		if m.Value != "" {
+			var err error
+			if target, err = e.expand(m.Value, domain, false); err != nil {
+				// The error is met again when the mechanism is evaluated.
+				return
+			}
+		}
+		switch m.Kind {
+		case "include":
+			e.prefetchPolicy(target)
+		case "a", "exists":
+			e.dns.prefetch(e.ctx, "ip", target)
+		case "mx":
+			e.dns.prefetch(e.ctx, "mx", target)
+		}
+	}
+	if redirect, ok := rec.Modifier("redirect"); ok && budget > 0 {
+		if target, err := e.expand(redirect, domain, false); err == nil {
+			e.prefetchPolicy(target)
+		}
+	}
+}
+
+// prefetchPolicy starts the lookups of a domain's SPF record.
+func (e *evaluator) prefetchPolicy(domain string) {
+	if e.spfType {
+		e.dns.prefetch(e.ctx, "spf", domain)
+	}
+	e.dns.prefetch(e.ctx, "txt", domain)
+}
+
+// expand expands the macros in a domain-spec found in a domain's record,
+// giving the name to look up, or in an explanation string when exp is set.
+func (e *evaluator) expand(spec, domain string, exp bool) (string, error) {
+	expanded, err := expandMacros(spec, macroContext{
+		sender: e.sender,
+		domain: domain,
+		ip:     e.ip,
+		helo:   e.helo,
+	}, exp)
+	if err != nil || exp {
+		return expanded, err
+	}
+	return fitDomainName(normalizeDomain(expanded))
+}
+
+// explain fetches and expands the explanation string published at the
+// target of an exp modifier. Any failure to find exactly one explanation
+// yields an empty string, as the explanation is only advisory.
+func (e *evaluator) explain(domain, exp string) string {
+	target, err := e.expand(exp, domain, false)
+	if err != nil {
+		return ""
+	}
+	txtRecords, err := e.dns.LookupTXT(e.ctx, target)
+	if err != nil || len(txtRecords) != 1 {
+		return ""
+	}
+	explanation, err := e.expand(txtRecords[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return explanation
+}
+
+// lookupSPFRecord fetches the SPF record of a domain named within another
+// record, by include or redirect. A domain without a record makes the naming
+// record a PermError, while transient DNS failures are left as TempErrors.
+func (e *evaluator) lookupSPFRecord(domain string) (string, error) {
+	// The prefetcher traces the lookups it makes itself.
+	txtRecords, dnssec, err := lookupPolicyRecords(e.ctx, e.dns, domain, e.spfType, nil, nil)
+	e.dnssec = e.dnssec.and(dnssec)
+	if isNotFound(err) {
+		return "", permError{ErrNoTXTRecords}
+	} else if errors.Is(err, ErrCNAMELoop) {
+		return "", permError{err}
+	} else if err != nil {
+		return "", err
+	}
+	spfRecordList, err := e.multiple.find(txtRecords)
+	if err != nil {
+		return "", permError{err}
+	}
+	return spfRecordList[0], nil
+}
+
+// matchMechanism reports whether a mechanism of a domain's record matches
+// the client IP.
+func (e *evaluator) matchMechanism(domain string, m Mechanism) (bool, error) {
+	switch m.Kind {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		// Neither family matches the other's networks.
+		if (e.ip.To4() != nil) != (m.Kind == "ip4") {
+			return false, nil
+		}
+		return m.Network().Contains(e.ip), nil
+	}
+
+	target := domain
+	if m.Value != "" {
+		var err error
+		if target, err = e.expand(m.Value, domain, false); err != nil {
+			return false, err
+		}
+	}
+	if err := e.useLookup(); err != nil {
+		return false, err
+	}
+	switch m.Kind {
+	case "include":
+		if err := e.checkInclude(domain, target); err != nil {
+			return false, err
+		}
+		// Including a record again cannot match where it failed to before;
+		// the term is counted, but not evaluated again.
+		if e.unmatched[canonicalDomain(target)] {
+			return false, nil
+		}
+		return e.matchInclude(target)
+	case "exists":
+		// exists always looks up A records, whatever the client's family.
+		ips, err := e.lookupIP(target)
+		if err != nil && !isNotFound(err) {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, e.useVoidLookup()
+	case "ptr":
+		return e.matchPTR(target)
+	case "a", "mx":
+		var ips []net.IP
+		var err error
+		if m.Kind == "a" {
+			ips, err = e.hostAddrs(target)
+		} else {
+			ips, err = e.mxAddrs(target)
+		}
+		if err != nil {
+			return false, err
+		}
+		// Only the addresses of the client's family are looked up by RFC
+		// 7208 sections 5.3 and 5.4, so a host without any is a void
+		// lookup.
+		ips = sameFamily(e.ip, ips)
+		if len(ips) == 0 {
+			return false, e.useVoidLookup()
+		}
+		return matchHosts(e.ip, ips, m.CIDR4, m.CIDR6), nil
+	}
+	return false, nil
+}
+
+// matchInclude reports whether an included record evaluates to Pass, per
+// RFC 7208 section 5.2. Any other result is not a match, except that errors
+// evaluating the record, and its absence, are passed on.
+func (e *evaluator) matchInclude(target string) (bool, error) {
+	if err := e.checkLoop(target); err != nil {
+		return false, err
+	}
+	record, err := e.lookupSPFRecord(target)
+	if errors.Is(err, ErrNoSPFRecords) {
+		// Unlike the checked domain, an included one without a record is
+		// a PermError, per RFC 7208 section 5.2.
+		return false, permError{fmt.Errorf("include of %s: %w", canonicalDomain(target), err)}
+	} else if err != nil {
+		return false, err
+	}
+	rec, err := parseRecord(record, !e.strict)
+	if err != nil {
+		return false, err
+	}
+	e.including++
+	res, _, err := e.checkHost(target, rec)
+	e.including--
+	if err != nil {
+		return false, err
+	}
+	if res != Pass {
+		e.unmatched[canonicalDomain(target)] = true
+	}
+	return res == Pass, nil
+}
+
+// maxPTRNames is the number of names from a reverse lookup that the ptr
+// mechanism will validate; any beyond it are ignored, per RFC 7208 section
+// 4.6.4.
+const maxPTRNames = 10
+
+// matchPTR reports whether the client IP has a validated domain name that is
+// the target domain or a subdomain of it. A name is validated when its own
+// addresses include the client IP. DNS errors make the mechanism not match.
+func (e *evaluator) matchPTR(target string) (bool, error) {
+	names, err := e.dns.LookupAddr(e.ctx, e.ip.String())
+	if isNotFound(err) || (err == nil && len(names) == 0) {
+		return false, e.useVoidLookup()
+	} else if err != nil {
+		return false, nil
+	}
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, err := e.lookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// mechanismName returns the lower-cased name of a mechanism, which ends at
+// the first ':' or '/'.
+func mechanismName(mechanism string) string {
+	if i := strings.IndexAny(mechanism, ":/"); i >= 0 {
+		return strings.ToLower(mechanism[:i])
+	}
+	return strings.ToLower(mechanism)
+}
+
+// splitCIDRs splits the dual-cidr-length suffix ("/24", "//64" or
+// "/24//64") from an a or mx mechanism. The IPv4 and IPv6 prefix lengths
+// default to 32 and 128 respectively.
+func splitCIDRs(mechanism string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+	if i := strings.Index(mechanism, "//"); i >= 0 {
+		n, err := parsePrefixLength(mechanism[i+2:], 128)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		mechanism, cidr6 = mechanism[:i], n
+	}
+	if i := strings.LastIndexByte(mechanism, '/'); i >= 0 {
+		n, err := parsePrefixLength(mechanism[i+1:], 32)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		mechanism, cidr4 = mechanism[:i], n
+	}
+	return mechanism, cidr4, cidr6, nil
+}
+
+// parsePrefixLength parses a CIDR prefix length of at most max bits.
+func parsePrefixLength(s string, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max || strings.TrimLeft(s, "0123456789") != "" || (len(s) > 1 && s[0] == '0') {
+		return 0, permError{fmt.Errorf("CIDR prefix length %q is not a number from 0 to %d", s, max)}
+	}
+	return n, nil
+}
+
+// hostAddrs returns the IPv4 and IPv6 addresses of a host, which has none if
+// it does not exist.
+func (e *evaluator) hostAddrs(host string) ([]net.IP, error) {
+	ips, err := e.lookupIP(host)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// maxMXRecords is the number of MX records an mx mechanism's domain may
+// have, each needing a lookup of its host's addresses, per RFC 7208 section
+// 4.6.4.
+const maxMXRecords = 10
+
+// maxMXAddrs is the number of addresses each of those hosts may have.
+const maxMXAddrs = 10
+
+// mxAddrs returns the IPv4 and IPv6 addresses of all of a domain's MX hosts.
+// A domain without MX records, or that does not exist, has none; one with
+// more than maxMXRecords, or with a host of more than maxMXAddrs addresses,
+// is a PermError.
+func (e *evaluator) mxAddrs(domain string) ([]net.IP, error) {
+	mxs, err := e.dns.LookupMX(e.ctx, domain)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(mxs) > maxMXRecords {
+		return nil, permError{fmt.Errorf("%s: %w: %d of %d", domain, ErrTooManyMXRecords, len(mxs), maxMXRecords)}
+	}
+	for _, mx := range mxs {
+		e.dns.prefetch(e.ctx, "ip", mx.Host)
+	}
+	var ips []net.IP
+	for _, mx := range mxs {
+		hostIPs, err := e.hostAddrs(mx.Host)
+		if err != nil {
+			return nil, err
+		}
+		if len(hostIPs) > maxMXAddrs {
+			return nil, permError{fmt.Errorf("%s: %w: %d of %d", mx.Host, ErrTooManyMXAddresses, len(hostIPs), maxMXAddrs)}
+		}
+		ips = append(ips, hostIPs...)
+	}
+	return ips, nil
+}
+
+// sameFamily returns the addresses among ips of the same family as
+// clientIP: IPv4 for an IPv4 client, and IPv6 for an IPv6 one.
+func sameFamily(clientIP net.IP, ips []net.IP) []net.IP {
+	v4 := clientIP.To4() != nil
+	var out []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// matchHosts reports whether the client IP lies within the network of the
+// given prefix length around any of a set of host addresses. Only addresses
+// of the client's own family are considered.
+func matchHosts(clientIP net.IP, hosts []net.IP, cidr4, cidr6 int) bool {
+	mask := net.CIDRMask(cidr6, 128)
+	if clientIP.To4() != nil {
+		clientIP, mask = clientIP.To4(), net.CIDRMask(cidr4, 32)
+	}
+	for _, ip := range hosts {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if len(ip) == len(clientIP) && ip.Mask(mask).Equal(clientIP.Mask(mask)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resultForError chooses the result for an error met during evaluation:
+// malformed record contents are a PermError, anything else (generally a
+// failed DNS lookup) a TempError. Either may come wrapped, as the errors of
+// redirects are.
+func resultForError(err error) Result {
+	var syntaxErr *SyntaxError
+	if errors.As(err, &syntaxErr) || errors.As(err, new(permError)) {
+		return PermError
+	}
+	return TempError
+}
+
+// permError marks an error that leaves a record unusable, so that it yields
+// PermError.
+type permError struct {
+	error
+}
+
+func (e permError) Unwrap() error {
+	return e.error
+}
@@ -0,0 +1,179 @@
+package spf
+
+import (
+	"context"
+	"strings"
+)
+
+// Flatten flattens a domain's SPF policy using the built-in SPF Checker;
+// see Checker.Flatten.
+func Flatten(domain string) (string, error) {
+	return looker.Flatten(domain)
+}
+
+// Flatten returns a record equivalent to a domain's SPF record, with its
+// includes and redirect replaced by the mechanisms of the records they
+// name, so that publishing it saves the lookups of those records. The
+// terminal all is kept, and where a record is redirected to, its exp.
+// Mechanisms that need lookups at check time, a, mx, ptr and exists, are
+// kept as they are, though those of other records are given their
+// domain. So are the includes and redirects whose targets have macros, or
+// whose records could not be moved without changing the meaning of a %{d}
+// macro. An include is replaced by the Pass mechanisms of its record, as
+// only they match it; where the record would deny an address ahead of
+// passing it, the include is kept, as leaving out the denial would let the
+// address match.
+func (sc *Checker) Flatten(domain string) (string, error) {
+	domain = normalizeDomain(domain)
+	ctx, cancel := sc.withTimeout(context.Background())
+	defer cancel()
+	records, err := sc.lookupSPFRecords(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	rec, err := parseRecord(records[0], !sc.Strict)
+	if err != nil {
+		return "", err
+	}
+	e := sc.newEvaluator(ctx, sc.newPrefetcher(), nil, "postmaster@"+domain, "")
+	f, err := e.flatten(domain, rec, true)
+	if err != nil {
+		return "", err
+	}
+	flat := new(Record)
+	// A mechanism repeated can never match where its first instance did
+	// not.
+	seen := make(map[Mechanism]bool)
+	for _, m := range f.mechanisms {
+		if !seen[m] {
+			seen[m] = true
+			flat.Mechanisms = append(flat.Mechanisms, m)
+		}
+	}
+	if f.redirect != "" {
+		flat.Modifiers = append(flat.Modifiers, Modifier{"redirect", f.redirect})
+	}
+	if f.exp != "" {
+		flat.Modifiers = append(flat.Modifiers, Modifier{"exp", f.exp})
+	}
+	return flat.String(), nil
+}
+
+// flatRecord is a record with its includes and redirect flattened.
+type flatRecord struct {
+	mechanisms []Mechanism
+	// redirect is the target of a redirect that could not be flattened.
+	redirect string
+	exp      string
+}
+
+// flatten flattens a domain's record. top is set for the checked domain's
+// own record, whose mechanisms are kept as written; the record of any other
+// domain is flattened to nil if it cannot be moved into another.
+func (e *evaluator) flatten(domain string, rec *Record, top bool) (*flatRecord, error) {
+	if err := e.enter(domain); err != nil {
+		return nil, err
+	}
+	defer e.leave(domain)
+	if len(e.visiting) > e.maxDepth+1 {
+		return nil, permError{ErrTooDeep}
+	}
+	f := new(flatRecord)
+	f.exp, _ = rec.Modifier("exp")
+	if !top && hasDomainMacro(f.exp) {
+		return nil, nil
+	}
+	for _, m := range rec.Mechanisms {
+		if !top && hasDomainMacro(m.Value) {
+			return nil, nil
+		}
+		switch m.Kind {
+		case "all":
+			f.mechanisms = append(f.mechanisms, m)
+			return f, nil
+		case "a", "mx", "ptr":
+			if !top && m.Value == "" {
+				m.Value = domain
+			}
+		case "include":
+			if strings.Contains(m.Value, "%") {
+				break
+			}
+			included, err := e.flattenTarget(m.Value)
+			if err != nil {
+				return nil, err
+			}
+			// An included record's redirect decides whether the include
+			// matches, so it can only be flattened along with the record.
+			if included == nil || included.redirect != "" || deniesFirst(included.mechanisms) {
+				break
+			}
+			// Only what passes within the included record matches the
+			// include.
+			for _, im := range included.mechanisms {
+				if im.Qualifier.Result() == Pass {
+					im.Qualifier = m.Qualifier
+					f.mechanisms = append(f.mechanisms, im)
+				}
+			}
+			continue
+		}
+		f.mechanisms = append(f.mechanisms, m)
+	}
+	if redirect, ok := rec.Modifier("redirect"); ok {
+		if !top && hasDomainMacro(redirect) {
+			return nil, nil
+		}
+		f.redirect = redirect
+		if strings.Contains(redirect, "%") {
+			return f, nil
+		}
+		target, err := e.flattenTarget(redirect)
+		if err != nil {
+			return nil, err
+		}
+		if target != nil {
+			// The explanation is that of the record redirected to.
+			f.mechanisms = append(f.mechanisms, target.mechanisms...)
+			f.redirect, f.exp = target.redirect, target.exp
+		}
+	}
+	return f, nil
+}
+
+// flattenTarget flattens the record of an include or redirect target.
+func (e *evaluator) flattenTarget(target string) (*flatRecord, error) {
+	if err := e.checkLoop(target); err != nil {
+		return nil, err
+	}
+	record, err := e.lookupSPFRecord(target)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseRecord(record, !e.strict)
+	if err != nil {
+		return nil, err
+	}
+	return e.flatten(normalizeDomain(target), rec, false)
+}
+
+// deniesFirst reports whether a mechanism that would not give Pass comes
+// ahead of one that would, so that the addresses it matches are kept from
+// passing by it.
+func deniesFirst(mechanisms []Mechanism) bool {
+	denied := false
+	for _, m := range mechanisms {
+		if m.Qualifier.Result() != Pass {
+			denied = true
+		} else if denied {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDomainMacro reports whether a domain-spec has a macro of the domain
+// whose record it is in, %{d}, which would change in moving it to another.
+func hasDomainMacro(spec string) bool {
+	return strings.Contains(strings.ToLower(spec), "%{d")
+}
@@ -0,0 +1,75 @@
+package spf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatten(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":       {"v=spf1 ip4:192.0.2.0/24 a include:_spf.example.com ~include:_spf2.example.com exists:%{i}.example.com redirect=rd.example.com exp=exp.example.com"},
+		"_spf.example.com":  {"v=spf1 ip6:2001:db8::/32 mx/24 ptr include:_spf2.example.com -ip4:10.0.0.1 -all"},
+		"_spf2.example.com": {"v=spf1 ip4:198.51.100.0/24 ?ip4:203.0.113.0/24"},
+		"rd.example.com":    {"v=spf1 a:mail.example.com -all exp=rd.example.com"},
+		"all.example.com":   {"v=spf1 ip4:192.0.2.1 -all include:_spf.example.com redirect=rd.example.com"},
+		"macro.example.com": {"v=spf1 include:_d.example.com include:%{ir}.example.com redirect=_d.example.com"},
+		"_d.example.com":    {"v=spf1 exists:%{d}.example.net ip4:192.0.2.1 -all"},
+		"loop.example.com":  {"v=spf1 include:loop.example.com"},
+		"deny.example.com":  {"v=spf1 include:inc.example.com ip4:198.51.100.0/24 -all"},
+		"inc.example.com":   {"v=spf1 -ip4:192.0.2.4 ip4:192.0.2.0/24 -all"},
+	})
+
+	record, err := sc.Flatten("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 ip4:192.0.2.0/24 a ip6:2001:db8::/32 mx:_spf.example.com/24 ptr:_spf.example.com "+
+		"ip4:198.51.100.0/24 ~ip4:198.51.100.0/24 exists:%{i}.example.com a:mail.example.com -all exp=rd.example.com", record)
+	_, err = ParseRecord(record)
+	assert.Nil(t, err)
+
+	// Nothing after all is kept, nor any redirect.
+	record, err = sc.Flatten("all.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 ip4:192.0.2.1 -all", record)
+
+	// Records that name their own domain through macros stay where they
+	// are.
+	record, err = sc.Flatten("macro.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 include:_d.example.com include:%{ir}.example.com redirect=_d.example.com", record)
+
+	// An include whose record denies addresses before passing others is
+	// kept.
+	record, err = sc.Flatten("deny.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 include:inc.example.com ip4:198.51.100.0/24 -all", record)
+
+	_, err = sc.Flatten("loop.example.com")
+	assert.True(t, errors.Is(err, ErrLoop))
+	_, err = sc.Flatten("missing.example.com")
+	assert.True(t, errors.Is(err, ErrNoSPFRecords))
+}
+
+func TestFlattenEquivalent(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"deny.example.com": {"v=spf1 include:inc.example.com ip4:198.51.100.0/24 -all"},
+		"inc.example.com":  {"v=spf1 -ip4:192.0.2.4 ip4:192.0.2.0/24 -all"},
+		"pass.example.com": {"v=spf1 include:_spf.example.com ~include:inc.example.com ?all"},
+		"_spf.example.com": {"v=spf1 ip4:203.0.113.0/24 ip6:2001:db8::/32 -ip4:203.0.113.9 ?all"},
+		"rd.example.com":   {"v=spf1 ip4:192.0.2.1 redirect=deny.example.com"},
+	})
+	// The flattened records give the same results as the originals.
+	for _, domain := range []string{"deny.example.com", "pass.example.com", "rd.example.com"} {
+		flat, err := sc.Flatten(domain)
+		assert.Nil(t, err, domain)
+		f.txt["flat."+domain] = []string{flat}
+		for _, ip := range []string{"192.0.2.1", "192.0.2.4", "198.51.100.1", "203.0.113.1", "203.0.113.9", "2001:db8::1", "10.0.0.1"} {
+			expected, err := sc.ValidateResult(ip, domain)
+			assert.Nil(t, err, domain)
+			res, err := sc.ValidateResult(ip, "flat."+domain)
+			assert.Nil(t, err, flat)
+			assert.Equal(t, expected, res, "%s from %s, flattened to %q", domain, ip, flat)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxHeaderLine is the line length that ReceivedSPFHeader folds at, as
+// recommended by RFC 5322 section 2.1.1.
+const maxHeaderLine = 78
+
+// ReceivedSPFHeader returns a Received-SPF header field recording the result
+// of checking ip against domain's SPF policy, per RFC 7208 section 9.1. The
+// envelopeFrom and helo identities are included when non-empty; an empty
+// envelopeFrom marks the check as having been of the HELO identity. Long
+// fields are folded, and the result has no trailing CRLF.
+func ReceivedSPFHeader(result Result, domain, ip, helo, envelopeFrom string) string {
+	identity, subject := "mailfrom", envelopeFrom
+	if envelopeFrom == "" {
+		identity, subject = "helo", domain
+	}
+	fields := []string{"Received-SPF:", result.String(), "(" + headerComment(result, subject, ip) + ")"}
+	fields = append(fields, "client-ip="+headerValue(ip)+";")
+	if envelopeFrom != "" {
+		fields = append(fields, "envelope-from="+headerValue(envelopeFrom)+";")
+	}
+	if helo != "" {
+		fields = append(fields, "helo="+headerValue(helo)+";")
+	}
+	fields = append(fields, "identity="+identity+";")
+	return foldHeader(strings.Join(fields, " "))
+}
+
+// headerComment returns the human-readable comment describing a result.
+func headerComment(result Result, subject, ip string) string {
+	var comment string
+	switch result {
+	case Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", subject, ip)
+	case Fail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", subject, ip)
+	case SoftFail:
+		comment = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", subject, ip)
+	case Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, subject)
+	case None:
+		comment = fmt.Sprintf("domain of %s does not designate permitted sender hosts", subject)
+	case TempError:
+		comment = fmt.Sprintf("temporary error in processing during lookup of %s", subject)
+	default:
+		comment = fmt.Sprintf("permanent error in processing domain of %s", subject)
+	}
+	// Parentheses and backslashes are only allowed in comments as
+	// quoted-pairs.
+	return strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(comment)
+}
+
+// headerValue formats the value of a key-value pair: as a dot-atom where it
+// is one, and otherwise as a quoted-string.
+func headerValue(value string) string {
+	if isDotAtom(value) {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// isDotAtom reports whether s is a dot-atom as defined by RFC 5322: runs of
+// atext separated by single dots.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// foldHeader folds a header field at its spaces so that no line is longer
+// than maxHeaderLine where that can be helped. Unfolding the result gives
+// back the original field.
+func foldHeader(field string) string {
+	words := strings.Split(field, " ")
+	var out strings.Builder
+	line := 0
+	for i, word := range words {
+		if i > 0 {
+			if line+1+len(word) > maxHeaderLine {
+				out.WriteString("\r\n")
+				line = 0
+			}
+			out.WriteByte(' ')
+			line++
+		}
+		out.WriteString(word)
+		line += len(word)
+	}
+	return out.String()
+}
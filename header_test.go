@@ -0,0 +1,45 @@
+package spf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceivedSPFHeader(t *testing.T) {
+	h := ReceivedSPFHeader(Pass, "example.com", "192.0.2.1", "mail.example.com", "alice@example.com")
+	assert.Equal(t, "Received-SPF: pass (domain of alice@example.com designates 192.0.2.1 as\r\n"+
+		" permitted sender) client-ip=192.0.2.1; envelope-from=\"alice@example.com\";\r\n"+
+		" helo=mail.example.com; identity=mailfrom;", h)
+
+	// Without an envelope sender, the HELO identity was checked.
+	h = ReceivedSPFHeader(None, "mail.example.com", "2001:db8::1", "mail.example.com", "")
+	assert.Equal(t, "Received-SPF: none (domain of mail.example.com does not designate permitted\r\n"+
+		" sender hosts) client-ip=\"2001:db8::1\"; helo=mail.example.com; identity=helo;", h)
+}
+
+func TestReceivedSPFHeaderQuoting(t *testing.T) {
+	h := ReceivedSPFHeader(Fail, "example.com", "192.0.2.1", "bad\"helo", `"odd (user)"@example.com`)
+	unfolded := strings.Replace(h, "\r\n", "", -1)
+	assert.Contains(t, unfolded, `(domain of "odd \(user\)"@example.com does not designate`)
+	assert.Contains(t, unfolded, `envelope-from="\"odd (user)\"@example.com";`)
+	assert.Contains(t, unfolded, `helo="bad\"helo";`)
+}
+
+func TestReceivedSPFHeaderFolding(t *testing.T) {
+	long := strings.Repeat("a", 40) + "@" + strings.Repeat("b", 40) + ".example"
+	for _, res := range []Result{None, Neutral, Pass, Fail, SoftFail, TempError, PermError} {
+		h := ReceivedSPFHeader(res, "example.com", "192.0.2.1", "mail.example.com", long)
+		assert.True(t, strings.HasPrefix(h, "Received-SPF: "+res.String()+" ("))
+		for _, line := range strings.Split(h, "\r\n")[1:] {
+			assert.True(t, strings.HasPrefix(line, " "), "continuation line %q", line)
+		}
+		for _, line := range strings.Split(h, "\r\n") {
+			// Only an unbreakable word may overrun the limit.
+			if len(line) > maxHeaderLine {
+				assert.NotContains(t, strings.TrimPrefix(line, " "), " ")
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build integration
+
+package spf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLiveSPFRecords checks real domains over DNS, and only runs with the
+// integration build tag: go test -tags integration. Its expectations hold
+// only as long as the domains' records do.
+func TestLiveSPFRecords(t *testing.T) {
+	ip := "93.95.224.70" // mail.1984.is
+	// vulpinedesigns.co.uk has an SPF record set
+	ok, err := Validate(ip, "vulpinedesigns.co.uk")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	// cathalgarvey.me has no SPF record set
+	ok, err = Validate(ip, "cathalgarvey.me")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
@@ -0,0 +1,145 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// CountLookups counts the terms of a domain's SPF policy requiring DNS
+// lookups, using the built-in SPF Checker; see Checker.CountLookups.
+func CountLookups(domain string) (int, error) {
+	return looker.CountLookups(domain)
+}
+
+// CountLookups counts the terms of a domain's SPF policy that require DNS
+// lookups; see Checker.Lookups. A policy needing more lookups than a check
+// allows, or more void lookups, is returned with its count and an error
+// matching ErrTooManyLookups or ErrTooManyVoidLookups.
+func (sc *Checker) CountLookups(domain string) (int, error) {
+	l, err := sc.Lookups(domain)
+	return l.Count, err
+}
+
+// Lookups are the DNS lookups that a domain's SPF policy needs, as
+// Checker.Lookups counts them.
+type Lookups struct {
+	// Count is the number of terms requiring DNS lookups.
+	Count int
+	// Void are the targets of the a, mx and exists mechanisms found to have
+	// no records, each time they are named, whose lookups count against
+	// the limit of void lookups.
+	Void []string
+}
+
+// Lookups counts the terms of a domain's SPF policy that require DNS
+// lookups, as a check would were none of them to match: its a, mx, ptr,
+// exists and include mechanisms and its redirect, and those of the records
+// they include or redirect to. As in a check, a record included again is
+// counted as a single lookup. The targets of a, mx and exists mechanisms
+// are looked up for any that are void. Targets with macros cannot be
+// followed without a message to check, so their terms are counted once
+// each. A policy needing more lookups than a check allows, or more void
+// lookups, is returned with an error matching ErrTooManyLookups or
+// ErrTooManyVoidLookups. The returned Lookups is never nil, even alongside
+// an error.
+func (sc *Checker) Lookups(domain string) (*Lookups, error) {
+	domain = normalizeDomain(domain)
+	ctx, cancel := sc.withTimeout(context.Background())
+	defer cancel()
+	l := new(Lookups)
+	records, err := sc.lookupSPFRecords(ctx, domain)
+	if err != nil {
+		return l, err
+	}
+	rec, err := parseRecord(records[0], !sc.Strict)
+	if err != nil {
+		return l, err
+	}
+	e := sc.newEvaluator(ctx, sc.newPrefetcher(), nil, "postmaster@"+domain, "")
+	if err := e.countLookups(domain, rec, l); err != nil {
+		return l, err
+	}
+	if l.Count > maxLookups {
+		return l, fmt.Errorf("%s: %w: %d of %d", domain, ErrTooManyLookups, l.Count, maxLookups)
+	}
+	if len(l.Void) > maxVoidLookups {
+		return l, fmt.Errorf("%s: %w: %d of %d", domain, ErrTooManyVoidLookups, len(l.Void), maxVoidLookups)
+	}
+	return l, nil
+}
+
+// countLookups counts the terms requiring DNS lookups in a domain's record
+// and the records it includes or redirects to.
+func (e *evaluator) countLookups(domain string, rec *Record, l *Lookups) error {
+	if err := e.enter(domain); err != nil {
+		return err
+	}
+	defer e.leave(domain)
+	if len(e.visiting) > e.maxDepth+1 {
+		return permError{ErrTooDeep}
+	}
+	for _, m := range rec.Mechanisms {
+		switch m.Kind {
+		case "all":
+			return nil
+		case "a", "mx", "exists":
+			l.Count++
+			target := domain
+			if m.Value != "" {
+				target = m.Value
+			}
+			if !strings.Contains(target, "%") && e.void(m.Kind, target) {
+				l.Void = append(l.Void, canonicalDomain(target))
+			}
+		case "ptr":
+			l.Count++
+		case "include":
+			l.Count++
+			if strings.Contains(m.Value, "%") || e.unmatched[canonicalDomain(m.Value)] {
+				continue
+			}
+			if err := e.targetLookups(m.Value, l); err != nil {
+				return err
+			}
+			e.unmatched[canonicalDomain(m.Value)] = true
+		}
+	}
+	if redirect, ok := rec.Modifier("redirect"); ok {
+		l.Count++
+		if strings.Contains(redirect, "%") {
+			return nil
+		}
+		return e.targetLookups(redirect, l)
+	}
+	return nil
+}
+
+// void reports whether the target of an a, mx or exists mechanism has no
+// records of the kind it looks up. Lookups that fail otherwise are not
+// void.
+func (e *evaluator) void(kind, target string) bool {
+	if kind == "mx" {
+		mxs, err := e.dns.LookupMX(e.ctx, target)
+		return len(mxs) == 0 && (err == nil || isNotFound(err))
+	}
+	addrs, err := e.dns.LookupIPAddr(e.ctx, target)
+	return len(addrs) == 0 && (err == nil || isNotFound(err))
+}
+
+// targetLookups counts the terms requiring DNS lookups in the record of an
+// include or redirect target.
+func (e *evaluator) targetLookups(target string, l *Lookups) error {
+	if err := e.checkLoop(target); err != nil {
+		return err
+	}
+	record, err := e.lookupSPFRecord(target)
+	if err != nil {
+		return err
+	}
+	rec, err := parseRecord(record, !e.strict)
+	if err != nil {
+		return err
+	}
+	return e.countLookups(target, rec, l)
+}
@@ -0,0 +1,94 @@
+package spf
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountLookups(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":       {"v=spf1 ip4:192.0.2.0/24 a mx include:_spf.example.com exists:%{i}.example.com include:%{d}.example.net redirect=rd.example.com"},
+		"_spf.example.com":  {"v=spf1 ip6:2001:db8::/32 ptr include:_spf2.example.com -all"},
+		"_spf2.example.com": {"v=spf1 a:mail.example.com ~all"},
+		"rd.example.com":    {"v=spf1 mx -all"},
+		"all.example.com":   {"v=spf1 a +all mx redirect=rd.example.com"},
+		"big.example.com":   {"v=spf1 include:example.com include:_spf.example.com a mx -all"},
+		"loop.example.com":  {"v=spf1 include:loop.example.com"},
+		"bad.example.com":   {"v=spf1 include:missing.example.com"},
+		"twice.example.com": {"v=spf1 include:_spf.example.com include:_spf.example.com " + strings.Repeat("a ", 5) + "-all"},
+	})
+	for _, host := range []string{"example.com", "all.example.com", "mail.example.com", "twice.example.com"} {
+		f.ip[host] = []net.IP{net.ParseIP("198.51.100.1")}
+	}
+	f.mx["example.com"] = []*net.MX{{Host: "mail.example.com", Pref: 10}}
+	f.mx["rd.example.com"] = f.mx["example.com"]
+
+	n, err := sc.CountLookups("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	n, err = sc.CountLookups("all.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = sc.CountLookups("big.example.com")
+	assert.True(t, errors.Is(err, ErrTooManyLookups))
+	assert.Equal(t, 14, n)
+
+	// A record included again is counted once more as an include, as a
+	// check counts it, so this is within the limit a check allows.
+	n, err = sc.CountLookups("twice.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	res, err := sc.ValidateResult("192.0.2.1", "twice.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+
+	_, err = sc.CountLookups("loop.example.com")
+	assert.True(t, errors.Is(err, ErrLoop))
+	_, err = sc.CountLookups("bad.example.com")
+	assert.True(t, errors.Is(err, ErrNoSPFRecords))
+	_, err = sc.CountLookups("missing.example.com")
+	assert.True(t, errors.Is(err, ErrNoSPFRecords))
+}
+
+func TestVoidLookups(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":       {"v=spf1 a:mail.example.com mx:nothing.example.com exists:%{i}.example.com include:_spf.example.com -all"},
+		"_spf.example.com":  {"v=spf1 a:gone.example.com"},
+		"void.example.com":  {"v=spf1 a:nothing.example.com include:example.com -all"},
+		"fail.example.com":  {"v=spf1 a:temp.example.com -all"},
+		"empty.example.com": {"v=spf1 exists:empty.example.com -all"},
+	})
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	f.ip["empty.example.com"] = []net.IP{}
+	f.fail["temp.example.com"] = &net.DNSError{Err: "server misbehaving", Name: "temp.example.com", IsTemporary: true}
+
+	l, err := sc.Lookups("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, l.Count)
+	assert.Equal(t, []string{"nothing.example.com", "gone.example.com"}, l.Void)
+
+	// More than two void lookups are flagged, as a check would fail on
+	// them.
+	n, err := sc.CountLookups("void.example.com")
+	assert.True(t, errors.Is(err, ErrTooManyVoidLookups), "%v", err)
+	assert.Equal(t, 7, n)
+	res, err := sc.ValidateResult("192.0.2.1", "void.example.com")
+	assert.Equal(t, PermError, res)
+	assert.True(t, errors.Is(err, ErrTooManyVoidLookups), "%v", err)
+
+	// Only names found to have no records are void.
+	l, err = sc.Lookups("fail.example.com")
+	assert.Nil(t, err)
+	assert.Empty(t, l.Void)
+	l, err = sc.Lookups("empty.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"empty.example.com"}, l.Void)
+	l, err = sc.Lookups("missing.example.com")
+	assert.True(t, errors.Is(err, ErrNoSPFRecords))
+	assert.Equal(t, 0, l.Count)
+}
@@ -0,0 +1,240 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// macroContext holds the values that macros expand to, per RFC 7208
+// section 7.
+type macroContext struct {
+	// sender is the envelope sender identity, as local-part@domain.
+	sender string
+	// domain is the domain whose record is currently being evaluated.
+	domain string
+	ip     net.IP
+	helo   string
+}
+
+// macroDelimiters are the characters a macro may split its value on.
+const macroDelimiters = ".-+,/_="
+
+// maxDomainLength and maxLabelLength are the lengths of the longest domain
+// name, without its trailing dot, and of the longest label in one, per RFC
+// 1035 section 2.3.4.
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+)
+
+// expandMacros expands the macros in a domain-spec, or in an explanation
+// string when exp is set. Explanations may additionally use the c, r and t
+// macros.
+func expandMacros(s string, mc macroContext, exp bool) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", permError{fmt.Errorf("macro string %q ends with %%", s)}
+		}
+		switch s[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", permError{fmt.Errorf("unterminated macro in %q", s)}
+			}
+			value, err := expandMacro(s[i+1:i+end], mc, exp)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += end
+		default:
+			return "", permError{fmt.Errorf("invalid macro %q in %q", s[i-1:i+1], s)}
+		}
+	}
+	return out.String(), nil
+}
+
+// fitDomainName returns an expanded domain-spec as a name that can be looked
+// up. Labels are removed from the left of a name longer than
+// maxDomainLength until it fits, per RFC 7208 section 7.3; a name with an
+// empty label or one longer than maxLabelLength is an error.
+func fitDomainName(name string) (string, error) {
+	for len(strings.TrimSuffix(name, ".")) > maxDomainLength {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	if err := checkDomainName(name); err != nil {
+		return "", permError{err}
+	}
+	return name, nil
+}
+
+// checkDomainName checks that a name, with or without its trailing dot, is
+// short enough to be a domain name and has no empty or overlong labels.
+func checkDomainName(name string) error {
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) > maxDomainLength {
+		return fmt.Errorf("domain name %.20q... is longer than %d characters", name, maxDomainLength)
+	}
+	for _, label := range strings.Split(trimmed, ".") {
+		if label == "" {
+			return fmt.Errorf("domain name %q has an empty label", name)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("domain name %q has a label longer than %d characters", name, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// expandMacro expands the body of a single %{...} macro: a letter, then
+// an optional digit count, reversal flag and delimiter set.
+func expandMacro(macro string, mc macroContext, exp bool) (string, error) {
+	if macro == "" {
+		return "", permError{fmt.Errorf("empty macro")}
+	}
+	letter := macro[0]
+	value, ok := macroValue(letter|0x20, mc, exp)
+	if !ok {
+		return "", permError{fmt.Errorf("unknown macro letter %q", letter)}
+	}
+
+	transformers := macro[1:]
+	digits, hasDigits := 0, false
+	for len(transformers) > 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+		digits = digits*10 + int(transformers[0]-'0')
+		transformers = transformers[1:]
+		hasDigits = true
+		if digits > 128 {
+			// Nothing has that many parts; stop counting before overflow.
+			digits = 128
+		}
+	}
+	if hasDigits && digits == 0 {
+		return "", permError{fmt.Errorf("macro %q keeps zero parts", macro)}
+	}
+	reverse := false
+	if len(transformers) > 0 && (transformers[0] == 'r' || transformers[0] == 'R') {
+		reverse = true
+		transformers = transformers[1:]
+	}
+	delimiters := transformers
+	if strings.Trim(delimiters, macroDelimiters) != "" {
+		return "", permError{fmt.Errorf("invalid macro delimiters %q", delimiters)}
+	}
+	if delimiters == "" {
+		delimiters = "."
+	}
+
+	var parts []string
+	for {
+		cut := strings.IndexAny(value, delimiters)
+		if cut < 0 {
+			parts = append(parts, value)
+			break
+		}
+		parts = append(parts, value[:cut])
+		value = value[cut+1:]
+	}
+	if reverse {
+		for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+			parts[l], parts[r] = parts[r], parts[l]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	value = strings.Join(parts, ".")
+
+	// Upper-case macro letters are URL-escaped.
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+		value = strings.Replace(value, "+", "%20", -1)
+	}
+	return value, nil
+}
+
+// macroValue returns the value of a lower-case macro letter.
+func macroValue(letter byte, mc macroContext, exp bool) (string, bool) {
+	localPart, senderDomain := splitSender(mc.sender)
+	switch letter {
+	case 's':
+		return mc.sender, true
+	case 'l':
+		return localPart, true
+	case 'o':
+		return senderDomain, true
+	case 'd':
+		return mc.domain, true
+	case 'i':
+		return dottedIP(mc.ip), true
+	case 'p':
+		// Validating the client's domain name costs DNS lookups that the
+		// RFC discourages; "unknown" is the permitted fallback.
+		return "unknown", true
+	case 'v':
+		if mc.ip.To4() != nil {
+			return "in-addr", true
+		}
+		return "ip6", true
+	case 'h':
+		return mc.helo, true
+	}
+	if !exp {
+		return "", false
+	}
+	switch letter {
+	case 'c':
+		return mc.ip.String(), true
+	case 'r':
+		return "unknown", true
+	case 't':
+		return strconv.FormatInt(time.Now().Unix(), 10), true
+	}
+	return "", false
+}
+
+// splitSender splits a sender identity into its local part and domain.
+func splitSender(sender string) (string, string) {
+	at := strings.LastIndexByte(sender, '@')
+	if at < 0 {
+		return "postmaster", sender
+	}
+	return sender[:at], sender[at+1:]
+}
+
+// dottedIP formats an IP as the i macro expands it: dotted-quad for IPv4,
+// and dot-separated nibbles for IPv6.
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip16 {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,85 @@
+package spf
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The examples from RFC 7208 section 7.4.
+func TestExpandMacros(t *testing.T) {
+	mc := macroContext{
+		sender: "strong-bad@email.example.com",
+		domain: "email.example.com",
+		ip:     net.ParseIP("192.0.2.3"),
+	}
+	for spec, expected := range map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}":   "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}":  "3.2.0.192.in-addr.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%%%_%-":                            "% %20",
+	} {
+		expanded, err := expandMacros(spec, mc, false)
+		assert.Nil(t, err, spec)
+		assert.Equal(t, expected, expanded, spec)
+	}
+
+	mc.ip = net.ParseIP("2001:db8::cb01")
+	expanded, err := expandMacros("%{ir}.%{v}._spf.%{d2}", mc, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", expanded)
+}
+
+func TestExpandMacrosErrors(t *testing.T) {
+	mc := macroContext{sender: "a@example.com", domain: "example.com", ip: net.ParseIP("192.0.2.3")}
+	for _, spec := range []string{"%", "%{d", "%{}", "%{x}", "%{d0}", "%{d2q}", "%a", "%{c}"} {
+		_, err := expandMacros(spec, mc, false)
+		assert.NotNil(t, err, spec)
+	}
+	expanded, err := expandMacros("%{c} is not allowed", mc, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.3 is not allowed", expanded)
+	expanded, err = expandMacros("%{L}", macroContext{sender: "a b@example.com"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "a%20b", expanded)
+}
+
+func TestFitDomainName(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	long := strings.Repeat(label+".", 4) + "example.com"
+	name, err := fitDomainName(long)
+	assert.Nil(t, err)
+	// Whole labels are removed from the left until the name fits.
+	assert.Equal(t, strings.Repeat(label+".", 3)+"example.com", name)
+	name, err = fitDomainName(long + ".")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat(label+".", 3)+"example.com.", name)
+
+	for _, name := range []string{
+		label + "a.example.com",
+		"www..example.com",
+		".example.com",
+		strings.Repeat("a", 300),
+	} {
+		_, err := fitDomainName(name)
+		assert.IsType(t, permError{}, err, name)
+	}
+}
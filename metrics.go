@@ -0,0 +1,16 @@
+package spf
+
+// Metrics receives counts of what a Checker does, for monitoring. Its
+// methods may be called from more than one goroutine at once.
+type Metrics interface {
+	// CacheHit is called when a domain's SPF records are found in the
+	// cache, and CacheMiss when they must be looked up.
+	CacheHit()
+	CacheMiss()
+	// Lookup is called for each DNS lookup made, with the type of records
+	// looked up ("TXT", "SPF", "IP", "MX" or "PTR"). Lookups that a check
+	// starts ahead of need, and is decided without, are not counted.
+	Lookup(kind string)
+	// Outcome is called with the result of each check.
+	Outcome(r Result)
+}
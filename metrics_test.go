@@ -0,0 +1,71 @@
+package spf
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingMetrics counts the events it is told of.
+type countingMetrics struct {
+	mu       sync.Mutex
+	hits     int
+	misses   int
+	lookups  map[string]int
+	outcomes map[Result]int
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{lookups: make(map[string]int), outcomes: make(map[Result]int)}
+}
+
+func (m *countingMetrics) CacheHit() {
+	m.mu.Lock()
+	m.hits++
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) CacheMiss() {
+	m.mu.Lock()
+	m.misses++
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) Lookup(kind string) {
+	m.mu.Lock()
+	m.lookups[kind]++
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) Outcome(r Result) {
+	m.mu.Lock()
+	m.outcomes[r]++
+	m.mu.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 include:_spf.example.com a -all"},
+		"_spf.example.com": {"v=spf1 ip4:198.51.100.0/24 -all"},
+	})
+	f.ip["example.com"] = []net.IP{net.ParseIP("192.0.2.1")}
+	metrics := newCountingMetrics()
+	sc.Metrics = metrics
+
+	for _, ip := range []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"} {
+		sc.ValidateResult(ip, "example.com")
+	}
+	sc.ValidateResult("192.0.2.1", "none.example.com")
+	sc.ValidateIP(nil, "example.com")
+
+	assert.Equal(t, 2, metrics.hits)
+	assert.Equal(t, 2, metrics.misses)
+	// Only the checked domains' records are cached; the lookups made while
+	// evaluating them are made afresh for each check. The a mechanism's
+	// lookup is started ahead of need, but is only counted where the
+	// include does not decide the check first.
+	assert.Equal(t, map[string]int{"TXT": 5, "IP": 2}, metrics.lookups)
+	assert.Equal(t, map[Result]int{Pass: 2, Fail: 1, None: 1, PermError: 1}, metrics.outcomes)
+}
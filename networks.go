@@ -0,0 +1,293 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks are the networks that a domain's SPF policy names, for building
+// allowlists without a particular client in mind. The mechanisms are listed
+// whatever their order, so a network can be both authorized and denied
+// where a check would be decided by whichever came first.
+type Networks struct {
+	// Authorized are the networks of the mechanisms that yield Pass,
+	// directly or through the includes that do.
+	Authorized []*net.IPNet
+	// Denied are the networks of the mechanisms that yield Fail or
+	// SoftFail, and those that an included record denies ahead of the
+	// networks it passes, which are kept from matching the include.
+	Denied []*net.IPNet
+	// Warnings describe the mechanisms that cannot be listed as networks:
+	// exists, ptr, and those whose targets have macros.
+	Warnings []string
+}
+
+// AuthorizedNetworks returns the networks that a domain's SPF policy
+// authorizes, using the built-in SPF Checker.
+func AuthorizedNetworks(domain string) ([]*net.IPNet, error) {
+	return looker.AuthorizedNetworks(domain)
+}
+
+// AuthorizedNetworks returns the networks that a domain's SPF policy
+// authorizes; see Networks.
+func (sc *Checker) AuthorizedNetworks(domain string) ([]*net.IPNet, error) {
+	n, err := sc.Networks(domain)
+	if err != nil {
+		return nil, err
+	}
+	return n.Authorized, nil
+}
+
+// Networks returns the networks that a domain's SPF policy names, following
+// its a, mx and include mechanisms and its redirect within the usual DNS
+// lookup limits. A domain without an SPF record is an error matching
+// ErrNoSPFRecords.
+func (sc *Checker) Networks(domain string) (*Networks, error) {
+	p, err := sc.policyNetworks(domain)
+	if err != nil {
+		return nil, err
+	}
+	n := &Networks{Warnings: p.warnings}
+	for _, pn := range p.nets {
+		switch pn.result {
+		case Pass:
+			if !pn.excluded {
+				n.Authorized = append(n.Authorized, pn.nets...)
+			}
+		case Fail, SoftFail:
+			n.Denied = append(n.Denied, pn.nets...)
+		}
+	}
+	return n, nil
+}
+
+// Summary groups the networks that a domain's SPF policy names by the
+// result of a check of a client within them, of all but its final all
+// mechanism, which decides the Default. As with Networks, a network can be
+// listed under more than one result where a check would be decided by
+// whichever came first.
+type Summary struct {
+	Pass     []*net.IPNet
+	Fail     []*net.IPNet
+	SoftFail []*net.IPNet
+	Neutral  []*net.IPNet
+	// Default is the result of a check of a client in none of the
+	// networks: that of the all mechanism ending the domain's record or
+	// that of its redirect target, or otherwise Neutral.
+	Default Result
+	// Warnings describe the mechanisms that cannot be listed as networks,
+	// as in Networks.
+	Warnings []string
+}
+
+// PolicySummary summarizes a domain's SPF policy using the built-in SPF
+// Checker; see Checker.PolicySummary.
+func PolicySummary(domain string) (*Summary, error) {
+	return looker.PolicySummary(domain)
+}
+
+// PolicySummary groups the networks that a domain's SPF policy names by the
+// result they get, as Networks lists them, along with the result for
+// clients in none of them.
+func (sc *Checker) PolicySummary(domain string) (*Summary, error) {
+	p, err := sc.policyNetworks(domain)
+	if err != nil {
+		return nil, err
+	}
+	s := &Summary{Default: Neutral, Warnings: p.warnings}
+	for _, pn := range p.nets {
+		// A network kept from matching an include gets whatever the
+		// mechanisms after the include give it.
+		if pn.excluded {
+			continue
+		}
+		if pn.all {
+			s.Default = pn.result
+			continue
+		}
+		switch pn.result {
+		case Pass:
+			s.Pass = append(s.Pass, pn.nets...)
+		case Fail:
+			s.Fail = append(s.Fail, pn.nets...)
+		case SoftFail:
+			s.SoftFail = append(s.SoftFail, pn.nets...)
+		case Neutral:
+			s.Neutral = append(s.Neutral, pn.nets...)
+		}
+	}
+	return s, nil
+}
+
+// policyNets are the networks named by a domain's record, in the order
+// they are named, and the warnings about those that cannot be.
+type policyNets struct {
+	nets     []policyNet
+	warnings []string
+}
+
+// policyNet is a mechanism's networks and the result of a match within
+// them. all is set for the all mechanism ending the record evaluated, or
+// that of the record it redirects to. excluded is set for the networks an
+// included record denies ahead of networks it passes, which do not match
+// the include, whatever their result within it.
+type policyNet struct {
+	result   Result
+	nets     []*net.IPNet
+	all      bool
+	excluded bool
+}
+
+// policyNetworks lists the networks named by a domain's policy.
+func (sc *Checker) policyNetworks(domain string) (*policyNets, error) {
+	domain = normalizeDomain(domain)
+	ctx, cancel := sc.withTimeout(context.Background())
+	defer cancel()
+	records, err := sc.lookupSPFRecords(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseRecord(records[0], !sc.Strict)
+	if err != nil {
+		return nil, err
+	}
+	e := sc.newEvaluator(ctx, sc.newPrefetcher(), nil, "postmaster@"+domain, "")
+	return e.networks(domain, rec)
+}
+
+// networks lists the networks named by a domain's record.
+func (e *evaluator) networks(domain string, rec *Record) (*policyNets, error) {
+	if err := e.enter(domain); err != nil {
+		return nil, err
+	}
+	defer e.leave(domain)
+	p := new(policyNets)
+	add := func(q Qualifier, nets ...*net.IPNet) {
+		p.nets = append(p.nets, policyNet{result: q.Result(), nets: nets})
+	}
+	for _, m := range rec.Mechanisms {
+		if m.Kind == "exists" || m.Kind == "ptr" || strings.Contains(m.Value, "%") {
+			p.warnings = append(p.warnings, fmt.Sprintf("%s: %s cannot be listed as networks", domain, m))
+			continue
+		}
+		switch m.Kind {
+		case "all":
+			p.nets = append(p.nets, policyNet{result: m.Qualifier.Result(), all: true, nets: []*net.IPNet{
+				{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+				{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+			}})
+			return p, nil
+		case "ip4", "ip6":
+			add(m.Qualifier, m.Network())
+		case "a", "mx":
+			target := domain
+			if m.Value != "" {
+				target = m.Value
+			}
+			if err := e.useLookup(); err != nil {
+				return nil, err
+			}
+			var ips []net.IP
+			var err error
+			if m.Kind == "a" {
+				ips, err = e.hostAddrs(target)
+			} else {
+				ips, err = e.mxAddrs(target)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(ips) == 0 {
+				if err := e.useVoidLookup(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			nets := make([]*net.IPNet, len(ips))
+			for i, ip := range ips {
+				nets[i] = hostNetwork(ip, m.CIDR4, m.CIDR6)
+			}
+			add(m.Qualifier, nets...)
+		case "include":
+			if err := e.useLookup(); err != nil {
+				return nil, err
+			}
+			included, err := e.targetNetworks(m.Value)
+			if err != nil {
+				return nil, err
+			}
+			// Only what passes within the included record matches the
+			// include, and not what it denies first.
+			passes := 0
+			for i, pn := range included.nets {
+				if pn.result == Pass && !pn.excluded {
+					passes = i + 1
+				}
+			}
+			for i, pn := range included.nets {
+				switch {
+				case pn.result == Pass && !pn.excluded:
+					add(m.Qualifier, pn.nets...)
+				case i < passes && (pn.result == Fail || pn.result == SoftFail):
+					p.nets = append(p.nets, policyNet{result: pn.result, nets: pn.nets, excluded: true})
+					p.warnings = append(p.warnings, fmt.Sprintf("%s: %s does not match %s", domain, m, networkList(pn.nets)))
+				}
+			}
+			p.warnings = append(p.warnings, included.warnings...)
+		}
+	}
+	if redirect, ok := rec.Modifier("redirect"); ok {
+		if strings.Contains(redirect, "%") {
+			p.warnings = append(p.warnings, fmt.Sprintf("%s: redirect=%s cannot be listed as networks", domain, redirect))
+			return p, nil
+		}
+		if err := e.useLookup(); err != nil {
+			return nil, err
+		}
+		target, err := e.targetNetworks(redirect)
+		if err != nil {
+			return nil, err
+		}
+		p.nets = append(p.nets, target.nets...)
+		p.warnings = append(p.warnings, target.warnings...)
+	}
+	return p, nil
+}
+
+// targetNetworks lists the networks named by the record of an include or
+// redirect target.
+func (e *evaluator) targetNetworks(target string) (*policyNets, error) {
+	if err := e.checkLoop(target); err != nil {
+		return nil, err
+	}
+	record, err := e.lookupSPFRecord(target)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseRecord(record, !e.strict)
+	if err != nil {
+		return nil, err
+	}
+	return e.networks(target, rec)
+}
+
+// networkList returns networks in CIDR notation, separated by commas.
+func networkList(nets []*net.IPNet) string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return strings.Join(out, ", ")
+}
+
+// hostNetwork returns the network of the given prefix length around a host
+// address, for its family.
+func hostNetwork(ip net.IP, cidr4, cidr6 int) *net.IPNet {
+	mask := net.CIDRMask(cidr6, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(cidr4, 32)
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
@@ -0,0 +1,119 @@
+package spf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// networkStrings returns networks in CIDR notation.
+func networkStrings(nets []*net.IPNet) []string {
+	var out []string
+	for _, n := range nets {
+		out = append(out, n.String())
+	}
+	return out
+}
+
+func TestNetworks(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 ip4:192.0.2.0/24 -ip4:192.0.2.99 a/28 mx include:_spf.example.com -include:bad.example.com exists:%{i}.example.com redirect=rd.example.com"},
+		"_spf.example.com": {"v=spf1 ip6:2001:db8::/32 ~ip4:198.51.100.0/24 ptr -all"},
+		"bad.example.com":  {"v=spf1 ip4:203.0.113.0/24 -all"},
+		"rd.example.com":   {"v=spf1 ?ip4:10.0.0.0/8 ~all"},
+		"all.example.com":  {"v=spf1 ip4:192.0.2.0/24 +all ip4:198.51.100.0/24 redirect=rd.example.com"},
+		"loop.example.com": {"v=spf1 include:loop.example.com"},
+	})
+	f.ip["example.com"] = []net.IP{net.ParseIP("198.51.100.20"), net.ParseIP("2001:db8:1::1")}
+	f.mx["example.com"] = []*net.MX{{Host: "mx.example.com", Pref: 10}}
+	f.ip["mx.example.com"] = []net.IP{net.ParseIP("203.0.113.5")}
+
+	n, err := sc.Networks("example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"192.0.2.0/24", "198.51.100.16/28", "2001:db8:1::1/128", "203.0.113.5/32", "2001:db8::/32"},
+			networkStrings(n.Authorized))
+		// Ranges denied within includes after all they pass only stop the
+		// include matching, so these are only the checked domain's and its
+		// redirect target's.
+		assert.Equal(t, []string{"192.0.2.99/32", "203.0.113.0/24", "0.0.0.0/0", "::/0"}, networkStrings(n.Denied))
+		assert.Equal(t, []string{
+			"_spf.example.com: ptr cannot be listed as networks",
+			"example.com: exists:%{i}.example.com cannot be listed as networks",
+		}, n.Warnings)
+	}
+
+	// Ranges an included record denies before it passes others are kept
+	// from matching it.
+	f.txt["deny.example.com"] = []string{"v=spf1 include:inc.example.com ~all"}
+	f.txt["inc.example.com"] = []string{"v=spf1 -ip4:192.0.2.4 include:inc2.example.com ?ip4:10.0.0.0/8 -all"}
+	f.txt["inc2.example.com"] = []string{"v=spf1 ~ip4:192.0.2.8 ip4:192.0.2.0/24"}
+	n, err = sc.Networks("deny.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"192.0.2.0/24"}, networkStrings(n.Authorized))
+		assert.Equal(t, []string{"192.0.2.4/32", "192.0.2.8/32", "0.0.0.0/0", "::/0"}, networkStrings(n.Denied))
+		assert.Equal(t, []string{
+			"deny.example.com: include:inc.example.com does not match 192.0.2.4/32",
+			"deny.example.com: include:inc.example.com does not match 192.0.2.8/32",
+			"inc.example.com: include:inc2.example.com does not match 192.0.2.8/32",
+		}, n.Warnings)
+	}
+	s, err := sc.PolicySummary("deny.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"192.0.2.0/24"}, networkStrings(s.Pass))
+		assert.Empty(t, s.Fail)
+		assert.Empty(t, s.SoftFail)
+		assert.Equal(t, SoftFail, s.Default)
+	}
+
+	nets, err := sc.AuthorizedNetworks("all.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.0/24", "0.0.0.0/0", "::/0"}, networkStrings(nets))
+
+	_, err = sc.AuthorizedNetworks("loop.example.com")
+	assert.IsType(t, permError{}, err)
+	_, err = sc.AuthorizedNetworks("none.example.com")
+	assert.Equal(t, ErrNoTXTRecords, err)
+}
+
+func TestPolicySummary(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 ip4:192.0.2.0/24 ~ip4:198.51.100.0/24 ?ip6:2001:db8::/32 -a include:_spf.example.com ptr ~all"},
+		"_spf.example.com": {"v=spf1 ip4:203.0.113.0/24 -ip4:10.0.0.0/8 ?all"},
+		"rd.example.com":   {"v=spf1 ~include:_spf.example.com redirect=example.com"},
+		"open.example.com": {"v=spf1 include:all.example.com -all"},
+		"all.example.com":  {"v=spf1 +all"},
+		"bare.example.com": {"v=spf1 ip4:192.0.2.0/24"},
+	})
+	f.ip["example.com"] = []net.IP{net.ParseIP("192.0.2.99")}
+
+	s, err := sc.PolicySummary("example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"192.0.2.0/24", "203.0.113.0/24"}, networkStrings(s.Pass))
+		assert.Equal(t, []string{"198.51.100.0/24"}, networkStrings(s.SoftFail))
+		assert.Equal(t, []string{"192.0.2.99/32"}, networkStrings(s.Fail))
+		assert.Equal(t, []string{"2001:db8::/32"}, networkStrings(s.Neutral))
+		assert.Equal(t, SoftFail, s.Default)
+		assert.Equal(t, []string{"example.com: ptr cannot be listed as networks"}, s.Warnings)
+	}
+
+	// A redirect target's all decides the default.
+	s, err = sc.PolicySummary("rd.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"203.0.113.0/24", "198.51.100.0/24"}, networkStrings(s.SoftFail))
+		assert.Equal(t, SoftFail, s.Default)
+	}
+	// That of an included record only decides the include.
+	s, err = sc.PolicySummary("open.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"0.0.0.0/0", "::/0"}, networkStrings(s.Pass))
+		assert.Equal(t, Fail, s.Default)
+	}
+	s, err = sc.PolicySummary("bare.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, Neutral, s.Default)
+	}
+
+	_, err = sc.PolicySummary("none.example.com")
+	assert.Equal(t, ErrNoTXTRecords, err)
+}
@@ -0,0 +1,187 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// maxParallelLookups is the number of DNS lookups that a check will have in
+// flight ahead of the mechanisms that need them.
+const maxParallelLookups = 4
+
+// prefetcher is a Resolver that remembers the answers to the lookups of a
+// single check, and that can start lookups before they are needed. A record
+// is still evaluated one mechanism at a time, in order, so the lookups it
+// makes and the limits on them are unchanged; only the waiting for them
+// overlaps.
+type prefetcher struct {
+	r       Resolver
+	sem     chan struct{}
+	tracer  Tracer
+	metrics Metrics
+	retry   retryPolicy
+
+	mu      sync.Mutex
+	lookups map[lookupKey]*lookup
+}
+
+// lookupKey identifies a DNS lookup: one of the Resolver methods, by the
+// type of record it returns, and its name.
+type lookupKey struct {
+	kind string
+	name string
+}
+
+// lookup is the answer to a DNS lookup, which is ready once done is closed.
+type lookup struct {
+	done  chan struct{}
+	txt   []string
+	addrs []net.IPAddr
+	mx    []*net.MX
+	names []string
+	// dnssec is whether the txt records were authenticated.
+	dnssec DNSSECStatus
+	err    error
+	// attempts is the number of queries made for the lookup, which are
+	// told to the metrics once the check needs it.
+	attempts int
+	counted  bool
+}
+
+func newPrefetcher(r Resolver) *prefetcher {
+	return &prefetcher{
+		r:       r,
+		sem:     make(chan struct{}, maxParallelLookups),
+		lookups: make(map[lookupKey]*lookup),
+	}
+}
+
+// get returns the lookup of a name, starting it if it has not been, and
+// waiting for it to finish unless async.
+func (p *prefetcher) get(ctx context.Context, kind, name string, async bool) *lookup {
+	// A fully-qualified name is looked up once, without its trailing dot.
+	key := lookupKey{kind, strings.TrimSuffix(name, ".")}
+	p.mu.Lock()
+	l, started := p.lookups[key]
+	if !started {
+		l = &lookup{done: make(chan struct{})}
+		p.lookups[key] = l
+	}
+	p.mu.Unlock()
+	switch {
+	case started && !async:
+		<-l.done
+	case !started && async:
+		go func() {
+			defer close(l.done)
+			select {
+			case p.sem <- struct{}{}:
+				p.run(ctx, key, l)
+				<-p.sem
+			case <-ctx.Done():
+				l.err = ctx.Err()
+			}
+		}()
+	case !started:
+		p.run(ctx, key, l)
+		close(l.done)
+	}
+	if !async {
+		p.count(key, l)
+	}
+	return l
+}
+
+// count tells the metrics of the queries made for a finished lookup, the
+// first time the check needs it. Lookups started ahead of need that the
+// check never comes to are left out, as whether they are made at all
+// depends on how soon the check is decided.
+func (p *prefetcher) count(key lookupKey, l *lookup) {
+	if p.metrics == nil {
+		return
+	}
+	p.mu.Lock()
+	attempts := l.attempts
+	if l.counted {
+		attempts = 0
+	}
+	l.counted = true
+	p.mu.Unlock()
+	for i := 0; i < attempts; i++ {
+		p.metrics.Lookup(strings.ToUpper(key.kind))
+	}
+}
+
+// run makes a lookup, retrying it as p.retry allows.
+func (p *prefetcher) run(ctx context.Context, key lookupKey, l *lookup) {
+	if l.err = ctx.Err(); l.err != nil {
+		return
+	}
+	l.err = p.retry.do(ctx, func() error {
+		p.runOnce(ctx, key, l)
+		return l.err
+	})
+}
+
+// runOnce makes a single attempt at a lookup.
+func (p *prefetcher) runOnce(ctx context.Context, key lookupKey, l *lookup) {
+	if p.tracer != nil {
+		p.tracer.Lookup(strings.ToUpper(key.kind), key.name)
+	}
+	l.attempts++
+	switch key.kind {
+	case "txt":
+		if ar, ok := p.r.(AuthenticatingResolver); ok {
+			var authenticated bool
+			l.txt, authenticated, l.err = ar.LookupTXTAuthenticated(ctx, key.name)
+			l.dnssec = authenticatedStatus(authenticated)
+		} else {
+			l.txt, l.err = p.r.LookupTXT(ctx, key.name)
+		}
+	case "ip":
+		l.addrs, l.err = p.r.LookupIPAddr(ctx, key.name)
+	case "mx":
+		l.mx, l.err = p.r.LookupMX(ctx, key.name)
+	case "ptr":
+		l.names, l.err = p.r.LookupAddr(ctx, key.name)
+	case "spf":
+		if sr, ok := p.r.(SPFTypeResolver); ok {
+			l.txt, l.err = sr.LookupSPF(ctx, key.name)
+		} else {
+			l.err = errors.New("resolver cannot look up SPF records")
+		}
+	}
+}
+
+// prefetch starts a lookup in the background.
+func (p *prefetcher) prefetch(ctx context.Context, kind, name string) {
+	p.get(ctx, kind, name, true)
+}
+
+func (p *prefetcher) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	l := p.get(ctx, "txt", name, false)
+	return l.txt, l.err
+}
+
+func (p *prefetcher) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	l := p.get(ctx, "ip", host, false)
+	return l.addrs, l.err
+}
+
+func (p *prefetcher) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	l := p.get(ctx, "mx", name, false)
+	return l.mx, l.err
+}
+
+func (p *prefetcher) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	l := p.get(ctx, "ptr", addr, false)
+	return l.names, l.err
+}
+
+func (p *prefetcher) LookupSPF(ctx context.Context, name string) ([]string, error) {
+	l := p.get(ctx, "spf", name, false)
+	return l.txt, l.err
+}
@@ -0,0 +1,559 @@
+package spf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError describes the term that makes an SPF record malformed.
+type SyntaxError struct {
+	Term   string
+	Reason string
+}
+
+// ErrSyntax is matched by every *SyntaxError with errors.Is.
+var ErrSyntax = errors.New("invalid SPF record")
+
+// ErrMalformedRecord is another name for ErrSyntax, matching the errors of
+// malformed records, wherever they are met in a check.
+var ErrMalformedRecord = ErrSyntax
+
+// ErrMissingVersion is also matched by the *SyntaxError of a record that
+// looks like an SPF record but does not begin with v=spf1, as when the
+// version was forgotten or mistyped. Such records are not found among a
+// domain's TXT records, so checks of the domain yield None.
+var ErrMissingVersion = errors.New("SPF record without v=spf1")
+
+// missingVersion is the reason given for records matching
+// ErrMissingVersion.
+const missingVersion = "record has SPF terms but does not begin with v=spf1"
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid SPF term %q: %s", e.Term, e.Reason)
+}
+
+// Is reports whether target is ErrSyntax, or ErrMissingVersion for a
+// record lacking the version.
+func (e *SyntaxError) Is(target error) bool {
+	return target == ErrSyntax || (target == ErrMissingVersion && e.Reason == missingVersion)
+}
+
+// Qualifier is the prefix of a mechanism that chooses the result when the
+// mechanism matches.
+type Qualifier string
+
+// The mechanism qualifiers, from RFC 7208 section 4.6.2.
+const (
+	QualifierPass     Qualifier = "+"
+	QualifierFail     Qualifier = "-"
+	QualifierSoftFail Qualifier = "~"
+	QualifierNeutral  Qualifier = "?"
+)
+
+// Result returns the result of a match by a mechanism with the qualifier.
+func (q Qualifier) Result() Result {
+	switch q {
+	case QualifierFail:
+		return Fail
+	case QualifierSoftFail:
+		return SoftFail
+	case QualifierNeutral:
+		return Neutral
+	}
+	return Pass
+}
+
+// Mechanism is a directive of an SPF record: a qualified test of the client
+// IP.
+type Mechanism struct {
+	Qualifier Qualifier
+	// Kind is the lower-cased mechanism name: "all", "include", "a", "mx",
+	// "ptr", "ip4", "ip6" or "exists".
+	Kind string
+	// Value is the mechanism's argument: the network address of ip4 and
+	// ip6, and otherwise a domain-spec that may contain macros. It is empty
+	// for mechanisms given without one.
+	Value string
+	// CIDR4 and CIDR6 are the prefix lengths given to a, mx, ip4 and ip6
+	// mechanisms, which default to 32 and 128.
+	CIDR4, CIDR6 int
+}
+
+// Network returns the network named by an ip4 or ip6 mechanism, or nil for
+// other kinds.
+func (m Mechanism) Network() *net.IPNet {
+	ip := net.ParseIP(m.Value)
+	switch m.Kind {
+	case "ip4":
+		mask := net.CIDRMask(m.CIDR4, 32)
+		return &net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}
+	case "ip6":
+		mask := net.CIDRMask(m.CIDR6, 128)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return nil
+}
+
+// String returns the mechanism as it would be written in a record, leaving
+// out the default qualifier and prefix lengths.
+func (m Mechanism) String() string {
+	var out strings.Builder
+	if m.Qualifier != QualifierPass {
+		out.WriteString(string(m.Qualifier))
+	}
+	out.WriteString(m.Kind)
+	if m.Value != "" {
+		out.WriteString(":" + m.Value)
+	}
+	switch m.Kind {
+	case "ip4":
+		if m.CIDR4 != 32 {
+			out.WriteString("/" + strconv.Itoa(m.CIDR4))
+		}
+	case "ip6":
+		if m.CIDR6 != 128 {
+			out.WriteString("/" + strconv.Itoa(m.CIDR6))
+		}
+	case "a", "mx":
+		if m.CIDR4 != 32 {
+			out.WriteString("/" + strconv.Itoa(m.CIDR4))
+		}
+		if m.CIDR6 != 128 {
+			out.WriteString("//" + strconv.Itoa(m.CIDR6))
+		}
+	}
+	return out.String()
+}
+
+// Modifier is a name=value term of an SPF record.
+type Modifier struct {
+	// Name is the lower-cased modifier name.
+	Name  string
+	Value string
+}
+
+// Record is a parsed SPF record.
+type Record struct {
+	// Mechanisms are the record's directives, in evaluation order.
+	Mechanisms []Mechanism
+	Modifiers  []Modifier
+}
+
+// Modifier returns the value of the named modifier, and whether the record
+// has it.
+func (r *Record) Modifier(name string) (string, bool) {
+	for _, mod := range r.Modifiers {
+		if mod.Name == name {
+			return mod.Value, true
+		}
+	}
+	return "", false
+}
+
+// String returns the record as it would be published: the version, the
+// mechanisms as Mechanism.String writes them, in order, and then the
+// modifiers. Parsing the result gives back the same Record.
+func (r *Record) String() string {
+	terms := []string{"v=spf1"}
+	for _, m := range r.Mechanisms {
+		terms = append(terms, m.String())
+	}
+	for _, mod := range r.Modifiers {
+		terms = append(terms, mod.Name+"="+mod.Value)
+	}
+	return strings.Join(terms, " ")
+}
+
+// jsonRecord is the JSON form of a Record.
+type jsonRecord struct {
+	Mechanisms []jsonMechanism `json:"mechanisms"`
+	Modifiers  []jsonModifier  `json:"modifiers,omitempty"`
+}
+
+// jsonMechanism is the JSON form of a Mechanism, without the default
+// prefix lengths.
+type jsonMechanism struct {
+	Qualifier Qualifier `json:"qualifier"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value,omitempty"`
+	CIDR4     *int      `json:"cidr4,omitempty"`
+	CIDR6     *int      `json:"cidr6,omitempty"`
+}
+
+type jsonModifier struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// MarshalJSON encodes the record as an object of its mechanisms, each with
+// its qualifier, kind, value and any prefix lengths that are not the
+// defaults, and its modifiers.
+func (r *Record) MarshalJSON() ([]byte, error) {
+	out := jsonRecord{Mechanisms: []jsonMechanism{}}
+	for _, m := range r.Mechanisms {
+		jm := jsonMechanism{Qualifier: m.Qualifier, Kind: m.Kind, Value: m.Value}
+		if m.CIDR4 != 32 {
+			jm.CIDR4 = &m.CIDR4
+		}
+		if m.CIDR6 != 128 {
+			jm.CIDR6 = &m.CIDR6
+		}
+		out.Mechanisms = append(out.Mechanisms, jm)
+	}
+	for _, mod := range r.Modifiers {
+		out.Modifiers = append(out.Modifiers, jsonModifier{mod.Name, mod.Value})
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a record encoded by MarshalJSON. The record must be
+// valid, as ParseRecord would have it; a missing qualifier is a Pass.
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var in jsonRecord
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	rec := new(Record)
+	for _, jm := range in.Mechanisms {
+		m := Mechanism{Qualifier: jm.Qualifier, Kind: jm.Kind, Value: jm.Value, CIDR4: 32, CIDR6: 128}
+		if m.Qualifier == "" {
+			m.Qualifier = QualifierPass
+		}
+		if jm.CIDR4 != nil {
+			m.CIDR4 = *jm.CIDR4
+		}
+		if jm.CIDR6 != nil {
+			m.CIDR6 = *jm.CIDR6
+		}
+		rec.Mechanisms = append(rec.Mechanisms, m)
+	}
+	for _, mod := range in.Modifiers {
+		rec.Modifiers = append(rec.Modifiers, Modifier{mod.Name, mod.Value})
+	}
+	// Parsing the record as written catches malformed terms, and those
+	// that would be read back as something else.
+	parsed, err := ParseRecord(rec.String())
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(parsed.Mechanisms, rec.Mechanisms) || !slices.Equal(parsed.Modifiers, rec.Modifiers) {
+		return &SyntaxError{rec.String(), "record does not read back as encoded"}
+	}
+	*r = *parsed
+	return nil
+}
+
+// Warnings describes the parts of a well-formed record that can never take
+// effect: mechanisms following an all mechanism, which are never reached,
+// and a redirect modifier alongside an all mechanism, which is ignored.
+func (r *Record) Warnings() []string {
+	var warnings []string
+	for i, m := range r.Mechanisms {
+		if m.Kind != "all" {
+			continue
+		}
+		if rest := r.Mechanisms[i+1:]; len(rest) > 0 {
+			terms := make([]string, len(rest))
+			for j, m := range rest {
+				terms[j] = m.String()
+			}
+			warnings = append(warnings, fmt.Sprintf("%s follows %s and is never evaluated", strings.Join(terms, " "), m))
+		}
+		if _, ok := r.Modifier("redirect"); ok {
+			warnings = append(warnings, fmt.Sprintf("redirect is ignored because of %s", m))
+		}
+		break
+	}
+	return warnings
+}
+
+// errUnknownMechanism is the reason given for terms that are neither a known
+// mechanism nor a modifier.
+var errUnknownMechanism = errors.New("unknown mechanism")
+
+// ParseRecord parses an SPF record according to the grammar of RFC 7208
+// section 12. The returned error, if any, is a *SyntaxError naming the
+// offending term. Records with more than one all mechanism, redirect or exp
+// modifier are also rejected. Records come from untrusted DNS, so any input
+// is either parsed or rejected with an error; none makes ParseRecord panic.
+func ParseRecord(record string) (*Record, error) {
+	return parseRecord(record, false)
+}
+
+// CheckSyntax reports whether an SPF record is well-formed, without
+// evaluating it. It returns the same errors as ParseRecord. Well-formed
+// records may still have parts that never take effect; see
+// Record.Warnings.
+func CheckSyntax(record string) error {
+	_, err := ParseRecord(record)
+	return err
+}
+
+// parseRecord parses an SPF record. If lenient, unknown mechanisms are left
+// out of the record rather than rejected, and an all mechanism after the
+// first is kept, never being reached, rather than rejected.
+func parseRecord(record string, lenient bool) (*Record, error) {
+	// Terms are separated by single spaces, but runs of spaces and tabs
+	// are found in published records too.
+	terms := strings.Fields(record)
+	if len(terms) == 0 {
+		return nil, &SyntaxError{"", "record does not begin with v=spf1"}
+	}
+	version, terms := terms[0], terms[1:]
+	if !strings.EqualFold(version, "v=spf1") {
+		if looksLikeSPF(append([]string{version}, terms...)) {
+			return nil, &SyntaxError{version, missingVersion}
+		}
+		return nil, &SyntaxError{version, "record does not begin with v=spf1"}
+	}
+	rec := new(Record)
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if strings.EqualFold(term, version) {
+			return nil, &SyntaxError{term, "version is not only at the start of the record"}
+		}
+		if name, value, ok := splitModifier(term); ok {
+			if err := checkModifier(name, value); err != nil {
+				return nil, &SyntaxError{term, err.Error()}
+			}
+			if name == "redirect" || name == "exp" {
+				if seen[name] {
+					return nil, &SyntaxError{term, fmt.Sprintf("more than one %s in record", name)}
+				}
+				seen[name] = true
+			}
+			rec.Modifiers = append(rec.Modifiers, Modifier{name, value})
+			continue
+		}
+		m, err := parseMechanism(term)
+		if err == errUnknownMechanism && lenient {
+			continue
+		} else if err != nil {
+			return nil, &SyntaxError{term, err.Error()}
+		}
+		if m.Kind == "all" {
+			if seen["all"] && !lenient {
+				return nil, &SyntaxError{term, "more than one all in record"}
+			}
+			seen["all"] = true
+		}
+		rec.Mechanisms = append(rec.Mechanisms, m)
+	}
+	return rec, nil
+}
+
+// looksLikeSPF reports whether the terms of a record without the SPF
+// version are nonetheless those of an SPF record: whether it begins with a
+// mistyped version, such as "spf1" or "v=spf1ip4:192.0.2.1", or has a
+// mechanism that could hardly be anything else, with a qualifier or an
+// argument, such as -all or ip4:192.0.2.1. Bare words such as "a" are not
+// enough, being found in prose.
+func looksLikeSPF(terms []string) bool {
+	first := strings.ToLower(terms[0])
+	if strings.HasPrefix(first, "v=spf") || strings.HasPrefix(first, "spf1") {
+		return true
+	}
+	for _, term := range terms {
+		m, err := parseMechanism(term)
+		if err != nil {
+			continue
+		}
+		if m.Value != "" || strings.ContainsRune("+-~?", rune(term[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSPFVersion reports whether a record starts with the SPF version term,
+// which is compared case-insensitively. The version is a whole term:
+// "v=spf10" is not an SPF record. Whitespace around the terms is ignored,
+// as parseRecord ignores it.
+func hasSPFVersion(record string) bool {
+	terms := strings.Fields(record)
+	return len(terms) > 0 && strings.EqualFold(terms[0], "v=spf1")
+}
+
+// checkModifier checks the value of a modifier.
+func checkModifier(name, value string) error {
+	switch name {
+	case "redirect", "exp":
+		return checkDomainSpec(value)
+	}
+	return checkMacroString(value)
+}
+
+// parseMechanism parses a single directive.
+func parseMechanism(term string) (Mechanism, error) {
+	m := Mechanism{Qualifier: QualifierPass, CIDR4: 32, CIDR6: 128}
+	if term != "" && strings.ContainsRune("+-~?", rune(term[0])) {
+		m.Qualifier, term = Qualifier(term[:1]), term[1:]
+	}
+	m.Kind = mechanismName(term)
+	// Lower-casing may change the length of a name that is not ASCII, so
+	// the arguments are found where the name was written to end.
+	args := ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		args = term[i:]
+	}
+	var err error
+	switch m.Kind {
+	case "all":
+		if args != "" {
+			err = fmt.Errorf("all takes no arguments")
+		}
+	case "include", "exists":
+		if !strings.HasPrefix(args, ":") {
+			err = fmt.Errorf("%s requires a domain", m.Kind)
+		} else {
+			m.Value = args[1:]
+			err = checkDomainSpec(m.Value)
+		}
+	case "a", "mx":
+		if args, m.CIDR4, m.CIDR6, err = splitCIDRs(args); err == nil && args != "" {
+			if !strings.HasPrefix(args, ":") {
+				err = fmt.Errorf("unexpected %q after %s", args, m.Kind)
+			} else {
+				m.Value = args[1:]
+				err = checkDomainSpec(m.Value)
+			}
+		}
+	case "ptr":
+		if args != "" {
+			if !strings.HasPrefix(args, ":") {
+				err = fmt.Errorf("unexpected %q after ptr", args)
+			} else {
+				m.Value = args[1:]
+				err = checkDomainSpec(m.Value)
+			}
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(args, ":") {
+			err = fmt.Errorf("%s requires a network", m.Kind)
+		} else {
+			err = parseNetwork(&m, args[1:])
+		}
+	default:
+		err = errUnknownMechanism
+	}
+	return m, err
+}
+
+// parseNetwork parses the network of an ip4 or ip6 mechanism, with its
+// optional prefix length.
+func parseNetwork(m *Mechanism, network string) error {
+	address, length := network, ""
+	if i := strings.IndexByte(network, '/'); i >= 0 {
+		address, length = network[:i], network[i+1:]
+	}
+	ip := net.ParseIP(address)
+	if m.Kind == "ip4" {
+		if ip == nil || ip.To4() == nil || strings.Contains(address, ":") {
+			return fmt.Errorf("invalid IPv4 address %q", address)
+		}
+	} else if ip == nil || !strings.Contains(address, ":") {
+		return fmt.Errorf("invalid IPv6 address %q", address)
+	}
+	m.Value = address
+	if length == "" && strings.HasSuffix(network, "/") {
+		return fmt.Errorf("missing prefix length")
+	} else if length != "" {
+		var err error
+		if m.Kind == "ip4" {
+			m.CIDR4, err = parsePrefixLength(length, 32)
+		} else {
+			m.CIDR6, err = parsePrefixLength(length, 128)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitModifier splits a modifier into its lower-cased name and its value.
+// It reports false for terms that are not modifiers.
+func splitModifier(term string) (string, string, bool) {
+	eq := strings.IndexByte(term, '=')
+	if eq <= 0 || !isModifierName(term[:eq]) {
+		return "", "", false
+	}
+	return strings.ToLower(term[:eq]), term[eq+1:], true
+}
+
+// isModifierName reports whether a string is a valid modifier name: a letter
+// followed by letters, digits, '-', '_' or '.'.
+func isModifierName(name string) bool {
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkMacroString checks that the macros in a string are well-formed.
+func checkMacroString(s string) error {
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e {
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	_, err := expandMacros(s, macroContext{ip: net.IPv4zero}, false)
+	return err
+}
+
+// checkDomainSpec checks a domain-spec: a macro string that ends either in a
+// macro or in a top-level domain label.
+func checkDomainSpec(spec string) error {
+	if spec == "" {
+		return fmt.Errorf("empty domain")
+	}
+	if err := checkMacroString(spec); err != nil {
+		return err
+	}
+	// Without macros, the domain-spec is the name looked up.
+	if !strings.Contains(spec, "%") {
+		if err := checkDomainName(spec); err != nil {
+			return err
+		}
+	}
+	if strings.HasSuffix(spec, "}") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(spec, "."), ".")
+	if len(labels) < 2 || !isTopLabel(labels[len(labels)-1]) {
+		return fmt.Errorf("%q does not end in a top-level domain", spec)
+	}
+	return nil
+}
+
+// isTopLabel reports whether a label may be a top-level domain: letters,
+// digits and hyphens, not wholly numeric, and not starting or ending with a
+// hyphen.
+func isTopLabel(label string) bool {
+	if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	numeric := true
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			numeric = false
+		case c >= '0' && c <= '9':
+		case c == '-':
+			numeric = false
+		default:
+			return false
+		}
+	}
+	return !numeric
+}
@@ -0,0 +1,267 @@
+package spf
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSyntaxValid(t *testing.T) {
+	for _, record := range []string{
+		"v=spf1",
+		"v=spf1 -all",
+		"v=spf1 ip4:192.0.2.0/24 ip4:192.0.2.1 ip6:2001:db8::/32 ip6:::1 ~all",
+		"v=spf1 a mx a:mail.example.com mx:example.com/24 a/24//64 mx//64 ?all",
+		"v=spf1 include:_spf.example.com exists:%{ir}.%{v}._spf.%{d2} ptr ptr:example.com -all",
+		"v=spf1 redirect=_spf.example.com",
+		"v=spf1 -all exp=explain._spf.%{d}",
+		"v=spf1 -all custom-modifier=anything%{d}",
+		"v=spf1 include:example.com.",
+		"V=SPF1 -all",
+		" v=spf1 -all",
+		"v=spf1  ip4:192.0.2.0/24  -all ",
+		"v=spf1\tip4:192.0.2.0/24 \t -all",
+		"v=spf1\t-all\r\n",
+		"v=spf1 ",
+		"v=spf1 \t ",
+	} {
+		assert.Nil(t, CheckSyntax(record), record)
+	}
+}
+
+func TestCheckSyntaxInvalid(t *testing.T) {
+	for record, term := range map[string]string{
+		"spf1 -all":                      "spf1",
+		"v=spf10 -all":                   "v=spf10",
+		"v=spf -all":                     "v=spf",
+		"v=spf1 ip4:192.0.2.0/33":        "ip4:192.0.2.0/33",
+		"v=spf1 ip4:2001:db8::1":         "ip4:2001:db8::1",
+		"v=spf1 ip6:192.0.2.1":           "ip6:192.0.2.1",
+		"v=spf1 ip4":                     "ip4",
+		"v=spf1 a/33":                    "a/33",
+		"v=spf1 mx//129":                 "mx//129",
+		"v=spf1 a4:192.0.2.1":            "a4:192.0.2.1",
+		"v=spf1 include":                 "include",
+		"v=spf1 include:localhost":       "include:localhost",
+		"v=spf1 exists:%{z}.example.com": "exists:%{z}.example.com",
+		"v=spf1 all:example.com":         "all:example.com",
+		"v=spf1 -all ~all":               "~all",
+		"v=spf1 redirect=a.example.com redirect=b.example.com": "redirect=b.example.com",
+		"v=spf1 exp=a.example.com exp=b.example.com":           "exp=b.example.com",
+		"v=spf1 redirect=":                 "redirect=",
+		"v=spf1 -all v=spf1":               "v=spf1",
+		"v=spf1 ip4:192.0.2.1 V=SPF1 -all": "V=SPF1",
+		"ip4:192.0.2.1 v=spf1 -all":        "ip4:192.0.2.1",
+		"-all":                             "-all",
+		"":                                 "",
+	} {
+		err := CheckSyntax(record)
+		if assert.IsType(t, &SyntaxError{}, err, record) {
+			assert.Equal(t, term, err.(*SyntaxError).Term, record)
+		}
+	}
+}
+
+func TestMissingVersion(t *testing.T) {
+	for record, missing := range map[string]bool{
+		"spf1 ip4:192.0.2.0/24 -all":                true,
+		"v=spf1ip4:192.0.2.0/24 -all":               true,
+		"v=spf 1 -all":                              true,
+		"ip4:192.0.2.0/24 include:_spf.example.com": true,
+		"include:_spf.example.com ~all":             true,
+		"google-site-verification=abc":              false,
+		"this is a test":                            false,
+		"MS=ms12345678":                             false,
+		"":                                          false,
+	} {
+		err := CheckSyntax(record)
+		assert.True(t, errors.Is(err, ErrSyntax), record)
+		assert.Equal(t, missing, errors.Is(err, ErrMissingVersion), record)
+	}
+
+	// Checks still find no record among such TXT records.
+	sc, _ := fakeChecker(map[string][]string{"example.com": {"spf1 ip4:192.0.2.0/24 -all"}})
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+}
+
+func TestParseRecord(t *testing.T) {
+	rec, err := ParseRecord("v=spf1 ip4:192.0.2.0/24 -a:mail.example.com/28//64 ~mx ?include:_spf.example.com ptr -all redirect=_spf.example.net x-custom=1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []Mechanism{
+		{QualifierPass, "ip4", "192.0.2.0", 24, 128},
+		{QualifierFail, "a", "mail.example.com", 28, 64},
+		{QualifierSoftFail, "mx", "", 32, 128},
+		{QualifierNeutral, "include", "_spf.example.com", 32, 128},
+		{QualifierPass, "ptr", "", 32, 128},
+		{QualifierFail, "all", "", 32, 128},
+	}, rec.Mechanisms)
+	assert.Equal(t, []Modifier{{"redirect", "_spf.example.net"}, {"x-custom", "1"}}, rec.Modifiers)
+	redirect, ok := rec.Modifier("redirect")
+	assert.True(t, ok)
+	assert.Equal(t, "_spf.example.net", redirect)
+	_, ok = rec.Modifier("exp")
+	assert.False(t, ok)
+
+	assert.Equal(t, "192.0.2.0/24", rec.Mechanisms[0].Network().String())
+	assert.Nil(t, rec.Mechanisms[1].Network())
+}
+
+func TestRecordWarnings(t *testing.T) {
+	for record, warnings := range map[string][]string{
+		"v=spf1 ip4:192.0.2.0/24 -all":                     nil,
+		"v=spf1 ip4:192.0.2.0/24 -all exp=exp.example.com": nil,
+		"v=spf1 redirect=_spf.example.com":                 nil,
+		"v=spf1 ~all ip4:192.0.2.0/24 -mx//64": {
+			"ip4:192.0.2.0/24 -mx//64 follows ~all and is never evaluated",
+		},
+		"v=spf1 a -all redirect=_spf.example.com": {
+			"redirect is ignored because of -all",
+		},
+	} {
+		rec, err := ParseRecord(record)
+		if assert.Nil(t, err, record) {
+			assert.Equal(t, warnings, rec.Warnings(), record)
+		}
+	}
+
+	// Evaluation does not depend on all being last.
+	checkResult(t, Fail, "192.0.2.1", "v=spf1 -all ip4:192.0.2.0/24")
+}
+
+func TestMechanismString(t *testing.T) {
+	for _, term := range []string{
+		"all", "-all", "ip4:192.0.2.0/24", "~ip4:192.0.2.1", "ip6:2001:db8::/32",
+		"?a", "a/24", "mx:example.com//64", "a:example.com/24//64",
+		"include:_spf.example.com", "exists:%{i}.example.com", "ptr", "ptr:example.com",
+	} {
+		m, err := parseMechanism(term)
+		if assert.Nil(t, err, term) {
+			assert.Equal(t, term, m.String())
+		}
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	for record, expected := range map[string]string{
+		"v=spf1":  "v=spf1",
+		"V=SPF1 ": "v=spf1",
+		"v=spf1 +ip4:192.0.2.0/24  -A:mail.example.com/28//64 ~mx/32 ?include:_spf.example.com ptr -all": "v=spf1 ip4:192.0.2.0/24 -a:mail.example.com/28//64 ~mx ?include:_spf.example.com ptr -all",
+		"v=spf1 Redirect=_spf.example.net X-Custom=%{d} ip6:2001:db8::/32":                               "v=spf1 ip6:2001:db8::/32 redirect=_spf.example.net x-custom=%{d}",
+	} {
+		rec, err := ParseRecord(record)
+		if !assert.Nil(t, err, record) {
+			continue
+		}
+		assert.Equal(t, expected, rec.String(), record)
+		again, err := ParseRecord(rec.String())
+		assert.Nil(t, err, record)
+		assert.Equal(t, rec, again, record)
+	}
+}
+
+func TestRecordJSON(t *testing.T) {
+	rec, err := ParseRecord("v=spf1 ip4:192.0.2.0/24 -a:mail.example.com//64 ip4:0.0.0.0/0 ~all redirect=_spf.example.net")
+	if !assert.Nil(t, err) {
+		return
+	}
+	data, err := json.Marshal(rec)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"mechanisms": [
+		{"qualifier": "+", "kind": "ip4", "value": "192.0.2.0", "cidr4": 24},
+		{"qualifier": "-", "kind": "a", "value": "mail.example.com", "cidr6": 64},
+		{"qualifier": "+", "kind": "ip4", "value": "0.0.0.0", "cidr4": 0},
+		{"qualifier": "~", "kind": "all"}
+	], "modifiers": [{"name": "redirect", "value": "_spf.example.net"}]}`, string(data))
+	decoded := new(Record)
+	assert.Nil(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, rec, decoded)
+
+	// The qualifier defaults to a Pass.
+	assert.Nil(t, json.Unmarshal([]byte(`{"mechanisms": [{"kind": "mx"}]}`), decoded))
+	assert.Equal(t, "v=spf1 mx", decoded.String())
+
+	for _, data := range []string{
+		`{"mechanisms": [{"kind": "ip4", "value": "example.com"}]}`,
+		`{"mechanisms": [{"kind": "a", "value": "example.com -all"}]}`,
+		`{"mechanisms": [{"kind": "a", "value": "example.com/24"}]}`,
+		`{"mechanisms": [{"kind": "bogus"}]}`,
+		`{"mechanisms": [], "modifiers": [{"name": "redirect", "value": ""}]}`,
+	} {
+		assert.NotNil(t, json.Unmarshal([]byte(data), new(Record)), data)
+	}
+}
+
+func TestParseRecordWhitespace(t *testing.T) {
+	for _, record := range []string{
+		"v=spf1  ip4:1.2.3.4   -all",
+		"\tv=spf1\tip4:1.2.3.4\t-all",
+		" v=spf1 ip4:1.2.3.4 \t -all \n",
+	} {
+		rec, err := ParseRecord(record)
+		if assert.Nil(t, err, "%q", record) {
+			assert.Equal(t, []Mechanism{
+				{QualifierPass, "ip4", "1.2.3.4", 32, 128},
+				{QualifierFail, "all", "", 32, 128},
+			}, rec.Mechanisms, "%q", record)
+		}
+	}
+}
+
+func TestParseCIDROnly(t *testing.T) {
+	rec, err := ParseRecord("v=spf1 a/24 mx//64 -mx/24//48 -all")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []Mechanism{
+			{QualifierPass, "a", "", 24, 128},
+			{QualifierPass, "mx", "", 32, 64},
+			{QualifierFail, "mx", "", 24, 48},
+			{QualifierFail, "all", "", 32, 128},
+		}, rec.Mechanisms)
+	}
+}
+
+func FuzzParseRecord(f *testing.F) {
+	for _, record := range []string{
+		"v=spf1 ip4:192.0.2.0/24 -a:mail.example.com/28//64 ~mx ?include:_spf.example.com ptr -all redirect=_spf.example.net",
+		"v=spf1 exists:%{ir}.%{v}._spf.%{d2} ip6:2001:db8::/32 -all exp=explain._spf.%{d}",
+		"v=spf1 a//64 mx/24 ip4:192.0.2.1/ ip6:: a:%{",
+		"v=spf1 redirect= exp== -",
+		"v=spf1 \t -all\r\n",
+		"V=SPF1",
+		// Lower-casing invalid UTF-8 lengthens it.
+		"v=spf1 \x92",
+		"",
+	} {
+		f.Add(record)
+	}
+	f.Fuzz(func(t *testing.T, record string) {
+		rec, err := ParseRecord(record)
+		if err != nil {
+			if rec != nil || !errors.Is(err, ErrSyntax) {
+				t.Fatalf("ParseRecord(%q) = %v, %v", record, rec, err)
+			}
+			return
+		}
+		rec.Warnings()
+		// A valid record, written out again, parses as the same record,
+		// as does its JSON.
+		again, err := ParseRecord(rec.String())
+		if err != nil || !reflect.DeepEqual(again, rec) {
+			t.Fatalf("ParseRecord(%q) = %q, which reparses as %v, %v", record, rec, again, err)
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := new(Record)
+		if err := json.Unmarshal(data, decoded); err != nil || !reflect.DeepEqual(decoded, rec) {
+			t.Fatalf("ParseRecord(%q) = %q, which decodes from %s as %v, %v", record, rec, data, decoded, err)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrNoTTLs is returned for TTLs asked of a Resolver that is not a
+// TTLResolver.
+var ErrNoTTLs = errors.New("resolver does not report TTLs")
+
+// Resolver is the set of DNS lookups that an SPF check makes. It is
+// satisfied by *net.Resolver, which is used by default; supply another to
+// route lookups elsewhere, or to answer them without DNS.
+type Resolver interface {
+	// LookupTXT returns each of a name's TXT records with its strings
+	// joined together without separators, as *net.Resolver does. Records
+	// are never joined to each other. A name that is an alias has the TXT
+	// records of the name at the end of its chain of CNAME records; a chain
+	// that loops is an error matching ErrCNAMELoop.
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	// LookupAddr is a reverse lookup, used by the ptr mechanism.
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// SPFTypeResolver is implemented by Resolvers that can look up the SPF (type
+// 99) records of RFC 4408, which the net package has no lookup for. CNAME
+// records are followed as by LookupTXT.
+type SPFTypeResolver interface {
+	LookupSPF(ctx context.Context, name string) ([]string, error)
+}
+
+// AuthenticatingResolver is implemented by Resolvers that can report whether
+// the TXT records they find were authenticated by DNSSEC, as a validating
+// resolver reports through the AD bit of its responses.
+type AuthenticatingResolver interface {
+	LookupTXTAuthenticated(ctx context.Context, name string) ([]string, bool, error)
+}
+
+// TTLResolver is implemented by Resolvers that can report how long the TXT
+// records they find may be cached for, which the net package discards.
+type TTLResolver interface {
+	// LookupTXTWithTTL is LookupTXT, along with the least of the TTLs of
+	// the records found and of any CNAME records followed to them.
+	LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+// lookupPolicyRecords returns the records of a domain among which its SPF
+// record is found. These are its TXT records, unless spfType is set, the
+// resolver can look up SPF records and the domain has some; RFC 4408 section
+// 4.5 then prefers those. The lookups are reported to any tracer and
+// metrics. DNSSEC authentication is only known of TXT records, and only
+// where r is an AuthenticatingResolver or a prefetcher.
+func lookupPolicyRecords(ctx context.Context, r Resolver, domain string, spfType bool, tracer Tracer, metrics Metrics) ([]string, DNSSECStatus, error) {
+	if sr, ok := r.(SPFTypeResolver); ok && spfType {
+		if tracer != nil {
+			tracer.Lookup("SPF", domain)
+		}
+		if metrics != nil {
+			metrics.Lookup("SPF")
+		}
+		// The SPF type is obsolete, so failing to find records of it is
+		// no reason not to use the TXT records.
+		if records, err := sr.LookupSPF(ctx, domain); err == nil && len(records) > 0 {
+			return records, DNSSECUnknown, nil
+		}
+	}
+	if tracer != nil {
+		tracer.Lookup("TXT", domain)
+	}
+	if metrics != nil {
+		metrics.Lookup("TXT")
+	}
+	switch r := r.(type) {
+	case *prefetcher:
+		l := r.get(ctx, "txt", domain, false)
+		return l.txt, l.dnssec, l.err
+	case AuthenticatingResolver:
+		records, authenticated, err := r.LookupTXTAuthenticated(ctx, domain)
+		return records, authenticatedStatus(authenticated), err
+	}
+	records, err := r.LookupTXT(ctx, domain)
+	return records, DNSSECUnknown, err
+}
+
+// authenticatedStatus returns the status of records reported as
+// authenticated or not.
+func authenticatedStatus(authenticated bool) DNSSECStatus {
+	if authenticated {
+		return DNSSECValidated
+	}
+	return DNSSECNotValidated
+}
@@ -0,0 +1,194 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ Resolver = (*net.Resolver)(nil)
+
+// fakeResolver answers lookups from fixed tables; any name missing from a
+// table does not exist. Lookups of names in hang block until cancelled, and
+// those of names in fail return the given error. Those of names in flaky
+// fail temporarily as many times as given before they are answered. Every
+// lookup takes latency.
+type fakeResolver struct {
+	txt     map[string][]string
+	ip      map[string][]net.IP
+	mx      map[string][]*net.MX
+	ptr     map[string][]string
+	hang    map[string]bool
+	fail    map[string]error
+	latency time.Duration
+	queries int32
+
+	mu    sync.Mutex
+	flaky map[string]int
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) query(ctx context.Context, name string) error {
+	atomic.AddInt32(&f.queries, 1)
+	select {
+	case <-time.After(f.latency):
+	case <-ctx.Done():
+	}
+	if f.hang[name] || ctx.Err() != nil {
+		<-ctx.Done()
+		return &net.DNSError{Err: ctx.Err().Error(), Name: name}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flaky[name] > 0 {
+		f.flaky[name]--
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return f.fail[name]
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := f.query(ctx, name); err != nil {
+		return nil, err
+	}
+	if txt, ok := f.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if err := f.query(ctx, host); err != nil {
+		return nil, err
+	}
+	ips, ok := f.ip[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
+}
+
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if err := f.query(ctx, name); err != nil {
+		return nil, err
+	}
+	if mxs, ok := f.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, notFound(name)
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := f.query(ctx, addr); err != nil {
+		return nil, err
+	}
+	if names, ok := f.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
+
+// fakeChecker returns a checker that resolves through a fake resolver with
+// the given TXT records.
+func fakeChecker(txt map[string][]string) (*Checker, *fakeResolver) {
+	f := &fakeResolver{
+		txt:  txt,
+		ip:   make(map[string][]net.IP),
+		mx:   make(map[string][]*net.MX),
+		ptr:  make(map[string][]string),
+		hang: make(map[string]bool),
+		fail: make(map[string]error),
+	}
+	return NewSPFCheckerWithResolver(f), f
+}
+
+func TestCheckerWithResolver(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+	})
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateResult("198.51.100.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	assert.EqualValues(t, 1, f.queries, "the record is cached after the first check")
+
+	assert.Equal(t, net.DefaultResolver, NewSPFCheckerWithResolver(nil).resolver)
+}
+
+func TestDNSFailures(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":     {"v=spf1 include:servfail.example.net -all"},
+		"nx.example.com":  {"v=spf1 include:nx.example.net -all"},
+		"rd.example.com":  {"v=spf1 redirect=nx.example.net"},
+		"mx.example.com":  {"v=spf1 mx:servfail.example.net -all"},
+		"txt.example.com": {"google-site-verification=abc"},
+	})
+	f.fail["timeout.example.com"] = &net.DNSError{Err: "i/o timeout", Name: "timeout.example.com", IsTimeout: true}
+	f.fail["servfail.example.com"] = &net.DNSError{Err: "server misbehaving", Name: "servfail.example.com", IsTemporary: true}
+	f.fail["servfail.example.net"] = &net.DNSError{Err: "server misbehaving", Name: "servfail.example.net", IsTemporary: true}
+
+	for domain, expected := range map[string]Result{
+		// No records at all, or none for SPF, means no policy.
+		"missing.example.com": None,
+		"txt.example.com":     None,
+		// Transient failures may be retried.
+		"timeout.example.com":  TempError,
+		"servfail.example.com": TempError,
+		"example.com":          TempError,
+		"mx.example.com":       TempError,
+		// Records naming a domain without a policy are broken.
+		"nx.example.com": PermError,
+		"rd.example.com": PermError,
+	} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Equal(t, expected, res, domain)
+		assert.Equal(t, expected == TempError || expected == PermError, err != nil, "%s: %v", domain, err)
+	}
+}
+
+func TestLookupRecord(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":          {"google-site-verification=abc", "v=spf1 ip4:198.51.100.1 -all"},
+		"multiple.example.com": {"v=spf1 -all", "v=spf1 +all"},
+		"txt.example.com":      {"google-site-verification=abc"},
+	})
+	record, err := sc.LookupRecord("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 ip4:198.51.100.1 -all", record)
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries), "the check uses the cached record")
+
+	_, err = sc.LookupRecord("multiple.example.com")
+	assert.Equal(t, ErrMultipleRecords, err)
+	_, err = sc.LookupRecord("txt.example.com")
+	assert.Equal(t, ErrNoSPFRecordInTXT, err)
+	assert.True(t, errors.Is(err, ErrNoSPFRecords))
+	_, err = sc.LookupRecord("missing.example.com")
+	assert.Equal(t, ErrNoTXTRecords, err)
+	assert.True(t, errors.Is(err, ErrNoSPFRecords))
+	assert.False(t, errors.Is(ErrMultipleRecords, ErrNoSPFRecords))
+
+	// Both are no policy at all.
+	for _, domain := range []string{"txt.example.com", "missing.example.com"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, None, res)
+	}
+}
@@ -0,0 +1,150 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Result is the outcome of an SPF check, as defined in RFC 7208 section 2.6.
+type Result int
+
+const (
+	// None means no SPF record was published for the domain.
+	None Result = iota
+	// Neutral means the domain makes no assertion about the client IP.
+	Neutral
+	// Pass means the client IP is authorized to send for the domain.
+	Pass
+	// Fail means the client IP is explicitly not authorized.
+	Fail
+	// SoftFail means the client IP is probably not authorized.
+	SoftFail
+	// TempError means a transient (generally DNS) error occurred; the check
+	// may succeed if retried later.
+	TempError
+	// PermError means the domain's SPF record could not be correctly
+	// interpreted, and manual intervention is required to fix it.
+	PermError
+)
+
+// String returns the canonical lowercase token for the result, as used in
+// Received-SPF headers.
+func (r Result) String() string {
+	switch r {
+	case None:
+		return "none"
+	case Neutral:
+		return "neutral"
+	case Pass:
+		return "pass"
+	case Fail:
+		return "fail"
+	case SoftFail:
+		return "softfail"
+	case TempError:
+		return "temperror"
+	case PermError:
+		return "permerror"
+	}
+	return "unknown"
+}
+
+// DNSSECStatus is whether the SPF records of a check were authenticated by
+// DNSSEC, as reported by the Resolver that fetched them.
+type DNSSECStatus int
+
+const (
+	// DNSSECUnknown means the Resolver cannot tell, as *net.Resolver
+	// cannot, or that a record was not fetched through DNS.
+	DNSSECUnknown DNSSECStatus = iota
+	// DNSSECValidated means every record was authenticated.
+	DNSSECValidated
+	// DNSSECNotValidated means a record was not authenticated.
+	DNSSECNotValidated
+)
+
+// String returns a word for the status, for logging.
+func (s DNSSECStatus) String() string {
+	switch s {
+	case DNSSECValidated:
+		return "validated"
+	case DNSSECNotValidated:
+		return "not validated"
+	}
+	return "unknown"
+}
+
+// and returns the status of records of both statuses together.
+func (s DNSSECStatus) and(other DNSSECStatus) DNSSECStatus {
+	switch {
+	case s == DNSSECNotValidated || other == DNSSECNotValidated:
+		return DNSSECNotValidated
+	case s == DNSSECUnknown || other == DNSSECUnknown:
+		return DNSSECUnknown
+	}
+	return DNSSECValidated
+}
+
+// Evaluation is the detailed outcome of an SPF check.
+type Evaluation struct {
+	Result Result
+	// Explanation is the explanation string the domain publishes through
+	// its exp modifier. It is only set for Fail results, and is empty if
+	// the domain publishes none or it cannot be fetched.
+	Explanation string
+	// Matched is the mechanism that decided the result, as written in the
+	// checked domain's record or that of the domain it redirects to. It
+	// is empty if no mechanism matched.
+	Matched string
+	// Trace is the path to the mechanism that matched, from the checked
+	// domain's record: the include and redirect terms followed, ending in
+	// the mechanism that matched. For a match within an include, this is
+	// a mechanism of the included record.
+	Trace []string
+	// EvaluatedDomain is the domain whose record decided the result: the
+	// checked domain, or the last domain redirected to from it. It is
+	// empty if no record was evaluated.
+	EvaluatedDomain string
+	// Unmatched are the mechanisms evaluated without matching before the
+	// result was decided, in the checked domain's record and those of the
+	// domains it redirects to.
+	Unmatched []string
+	// DNSSEC is whether the checked domain's record and those it includes
+	// or redirects to were authenticated by DNSSEC. It is only known for
+	// Resolvers that are AuthenticatingResolvers, such as DNSClient.
+	DNSSEC DNSSECStatus
+	// Warnings describe the includes evaluated of domains outside the
+	// Checker's AllowedIncludes.
+	Warnings []string
+}
+
+// describe returns a sentence describing how a check of ip against domain's
+// policy came to its result, which was reached with the given error.
+func (ev *Evaluation) describe(ip, domain string, err error) string {
+	switch {
+	case ev.Result == None:
+		return fmt.Sprintf("%s publishes no SPF record", domain)
+	case err != nil:
+		return fmt.Sprintf("checking IP %s against the SPF record of %s failed: %v", ip, domain, err)
+	}
+	tried := strings.Join(ev.Unmatched, ", ")
+	var out string
+	switch {
+	case ev.Matched == "" && tried == "":
+		out = fmt.Sprintf("IP %s matched nothing; record has no mechanisms", ip)
+	case ev.Matched == "":
+		out = fmt.Sprintf("IP %s did not match any of: %s; record has no all mechanism", ip, tried)
+	case strings.TrimLeft(ev.Matched, "+-~?") == "all" && tried == "":
+		out = fmt.Sprintf("IP %s matched only %s", ip, ev.Matched)
+	case strings.TrimLeft(ev.Matched, "+-~?") == "all":
+		out = fmt.Sprintf("IP %s did not match any of: %s; record ends in %s", ip, tried, ev.Matched)
+	case len(ev.Trace) > 1 && ev.Trace[len(ev.Trace)-1] != ev.Matched:
+		out = fmt.Sprintf("IP %s matched %s, through %s", ip, ev.Matched, ev.Trace[len(ev.Trace)-1])
+	default:
+		out = fmt.Sprintf("IP %s matched %s", ip, ev.Matched)
+	}
+	if ev.EvaluatedDomain != "" && ev.EvaluatedDomain != normalizeDomain(domain) {
+		out += fmt.Sprintf(", in the record of %s that %s redirects to", ev.EvaluatedDomain, domain)
+	}
+	return out
+}
@@ -0,0 +1,17 @@
+package spf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultStrings(t *testing.T) {
+	assert.Equal(t, "none", None.String())
+	assert.Equal(t, "neutral", Neutral.String())
+	assert.Equal(t, "pass", Pass.String())
+	assert.Equal(t, "fail", Fail.String())
+	assert.Equal(t, "softfail", SoftFail.String())
+	assert.Equal(t, "temperror", TempError.String())
+	assert.Equal(t, "permerror", PermError.String())
+}
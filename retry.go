@@ -0,0 +1,52 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// retryPolicy is how many times, and after how long, lookups that fail
+// temporarily are tried again.
+type retryPolicy struct {
+	retries int
+	delay   time.Duration
+}
+
+// retryPolicy returns the Checker's retry policy.
+func (sc *Checker) retryPolicy() retryPolicy {
+	return retryPolicy{sc.Retries, sc.RetryDelay}
+}
+
+// do calls lookup until it succeeds, fails other than temporarily, or has
+// been retried p.retries times, waiting p.delay before the first retry and
+// twice as long before each after it. Retrying stops early if ctx is done,
+// or would be before the next attempt were made; the last error is then
+// returned.
+func (p retryPolicy) do(ctx context.Context, lookup func() error) error {
+	err := lookup()
+	wait := p.delay
+	for i := 0; i < p.retries && isTemporary(err); i++ {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		err = lookup()
+		wait *= 2
+	}
+	return err
+}
+
+// isTemporary reports whether a lookup failed in a way that may clear up on
+// trying again: one that would make a check a TempError, rather than a name
+// found not to exist, a CNAME loop or a context that is done.
+func isTemporary(err error) bool {
+	return err != nil && !isNotFound(err) && !errors.Is(err, ErrCNAMELoop) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
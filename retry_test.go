@@ -0,0 +1,58 @@
+package spf
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetries(t *testing.T) {
+	records := map[string][]string{
+		"example.com":      {"v=spf1 include:_spf.example.com -all"},
+		"_spf.example.com": {"v=spf1 a:mail.example.com"},
+	}
+	flaky := func() map[string]int {
+		return map[string]int{"example.com": 1, "_spf.example.com": 2, "mail.example.com": 1}
+	}
+
+	// By default, each lookup is tried once.
+	sc, f := fakeChecker(records)
+	f.flaky = flaky()
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("192.0.2.1")}
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, TempError, res)
+
+	sc, f = fakeChecker(records)
+	f.flaky = flaky()
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("192.0.2.1")}
+	sc.Retries = 2
+	sc.RetryDelay = time.Millisecond
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	assert.EqualValues(t, 7, atomic.LoadInt32(&f.queries))
+
+	// Names that do not exist are not tried again.
+	atomic.StoreInt32(&f.queries, 0)
+	res, err = sc.ValidateResult("192.0.2.1", "missing.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries))
+
+	// Nor are lookups whose retries would outlast the check.
+	sc, f = fakeChecker(records)
+	f.flaky = map[string]int{"example.com": 1}
+	sc.Retries = 3
+	sc.RetryDelay = time.Hour
+	sc.MaxEvalDuration = time.Second
+	start := time.Now()
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, TempError, res)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries))
+}
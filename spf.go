@@ -1,19 +1,67 @@
 package spf
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/mail"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
-	// ErrNoSPFRecords when no TXT/SPF records are found or parsed.
+	// ErrNoSPFRecords when no TXT/SPF records are found or parsed. The
+	// errors returned for a domain without an SPF record are either
+	// ErrNoTXTRecords or ErrNoSPFRecordInTXT, which both match it with
+	// errors.Is.
 	ErrNoSPFRecords = errors.New("No SPF Records found.")
+	// ErrNoTXTRecords when a domain has no TXT records at all.
+	ErrNoTXTRecords error = noRecordsError("No TXT Records found.")
+	// ErrNoSPFRecordInTXT when a domain has TXT records, but none of them
+	// is an SPF record.
+	ErrNoSPFRecordInTXT error = noRecordsError("No SPF Record among the TXT Records found.")
+	// ErrNullSender when an email address is the null sender of a bounce,
+	// which has no domain; the HELO identity is checked instead, as
+	// ValidateMailFrom does.
+	ErrNullSender = errors.New("Null sender has no domain.")
+	// ErrMultipleAddresses when what should be a single email address is
+	// a list of them, or a group with more or fewer than one.
+	ErrMultipleAddresses = errors.New("Not a single email address.")
+	// ErrInvalidIP when the client IP is not a valid IPv4 or IPv6 address.
+	ErrInvalidIP = errors.New("Invalid client IP address.")
+	// ErrMultipleRecords when a domain publishes more than one SPF record,
+	// which makes its policy a PermError.
+	ErrMultipleRecords = errors.New("Multiple SPF Records found.")
+	// ErrCNAMELoop when the CNAME records followed to a domain's SPF record
+	// lead back to themselves, which makes the policy naming the domain a
+	// PermError. Resolvers report such loops with errors matching it.
+	ErrCNAMELoop = errors.New("CNAME Records loop.")
+
+	looker *Checker
 
-	looker *spfChecker
+	// now is the clock that cache entries are aged by.
+	now = time.Now
 )
 
+// noRecordsError is an error for a domain without an SPF record, which
+// matches ErrNoSPFRecords.
+type noRecordsError string
+
+func (e noRecordsError) Error() string {
+	return string(e)
+}
+
+// Is reports whether target is ErrNoSPFRecords.
+func (e noRecordsError) Is(target error) bool {
+	return target == ErrNoSPFRecords
+}
+
 func init() {
 	looker = NewSPFChecker()
 }
@@ -21,216 +69,955 @@ func init() {
 // Validate returns whether emails from a domain can be sent from a given IP.
 // This is the intended main entry point to this library.
 // If you have an email address, then use GetDomainFromEmail to get the domain.
-// Results from Validate are simply cached in RAM; extended and heavy use may
-// create a memory leak. If this is a problem, simply call the top-level
-// DumpCache function.
+// Results from Validate are simply cached in RAM, and never expire; extended
+// and heavy use may create a memory leak. If this is a problem, simply call
+// the top-level DumpCache function, or use a Checker made by
+// NewSPFCheckerWithTTL or NewSPFCheckerWithCapacity.
+// Validate reports both Pass and None (no SPF record) as true; use
+// ValidateResult to distinguish the other SPF outcomes.
 func Validate(ip, domain string) (bool, error) {
 	return looker.Validate(ip, domain)
 }
 
+// ValidateResult returns the SPF result for emails from a domain sent from a
+// given IP, using the built-in SPF Checker.
+func ValidateResult(ip, domain string) (Result, error) {
+	return looker.ValidateResult(ip, domain)
+}
+
+// ValidateIP is ValidateResult for an IP that has already been parsed.
+func ValidateIP(ip net.IP, domain string) (Result, error) {
+	return looker.ValidateIP(ip, domain)
+}
+
+// ValidateAnyIP returns the first of several IPs that may send emails for a
+// domain, and its result, using the built-in SPF Checker.
+func ValidateAnyIP(ips []string, domain string) (Result, string, error) {
+	return looker.ValidateAnyIP(ips, domain)
+}
+
+// Explain returns the SPF result for emails from a domain sent from a given
+// IP, and a sentence describing how it was reached, using the built-in SPF
+// Checker.
+func Explain(ip, domain string) (Result, string, error) {
+	return looker.Explain(ip, domain)
+}
+
+// ValidateRecord returns the SPF result for emails from a domain sent from a
+// given IP under the given record, using the built-in SPF Checker.
+func ValidateRecord(ip, domain, record string) (Result, error) {
+	return looker.ValidateRecord(ip, domain, record)
+}
+
+// ValidateContext is ValidateResult with a context governing the DNS lookups.
+func ValidateContext(ctx context.Context, ip, domain string) (Result, error) {
+	return looker.ValidateContext(ctx, ip, domain)
+}
+
+// ValidateMailFrom returns the SPF result for a message from the given MAIL
+// FROM address, using the built-in SPF Checker. If mailFrom is empty, the
+// HELO identity is checked instead.
+func ValidateMailFrom(ip, helo, mailFrom string) (Result, error) {
+	return looker.ValidateMailFrom(ip, helo, mailFrom)
+}
+
+// ValidateHELO returns the SPF result for the HELO identity of a client,
+// using the built-in SPF Checker.
+func ValidateHELO(ip, helo string) (Result, error) {
+	return looker.ValidateHELO(ip, helo)
+}
+
+// ValidateSender returns the SPF result for a message from the given
+// envelope sender, using the built-in SPF Checker.
+func ValidateSender(ip, sender string) (Result, error) {
+	return looker.ValidateSender(ip, sender)
+}
+
+// Check returns the detailed SPF evaluation for emails from a domain sent
+// from a given IP, using the built-in SPF Checker.
+func Check(ip, domain string) (*Evaluation, error) {
+	return looker.Check(ip, domain)
+}
+
+// CheckContext is Check with a context governing the DNS lookups.
+func CheckContext(ctx context.Context, ip, domain string) (*Evaluation, error) {
+	return looker.CheckContext(ctx, ip, domain)
+}
+
+// Evaluate evaluates a domain's SPF record, already fetched and parsed,
+// making its lookups through r, or net.DefaultResolver if r is nil. It runs
+// with the default settings of a Checker, and without a cache; see
+// Checker.Evaluate.
+func Evaluate(ctx context.Context, r Resolver, rec *Record, ip net.IP, domain, sender, helo string) (*Evaluation, error) {
+	return NewSPFCheckerWithResolver(r).Evaluate(ctx, rec, ip, domain, sender, helo)
+}
+
+// LookupRecord returns the SPF record a domain publishes, using the built-in
+// SPF Checker and its cache.
+func LookupRecord(domain string) (string, error) {
+	return looker.LookupRecord(domain)
+}
+
+// LookupRecordWithTTL returns the SPF record a domain publishes and how long
+// it may be cached for, using the built-in SPF Checker.
+func LookupRecordWithTTL(domain string) (string, time.Duration, error) {
+	return looker.LookupRecordWithTTL(domain)
+}
+
 // DumpCache dumps the cache from the built-in SPF Checker.
 func DumpCache() {
 	looker.DumpCache()
 }
 
-// spfChecker is a cached TXT looker-upper and SPF checker
-type spfChecker struct {
-	Cache map[string][]string
+// InvalidateDomain removes a domain from the cache of the built-in SPF
+// Checker.
+func InvalidateDomain(domain string) {
+	looker.InvalidateDomain(domain)
+}
+
+// WarmCache fetches and caches the SPF records of the given domains with the
+// built-in SPF Checker.
+func WarmCache(ctx context.Context, domains []string) error {
+	return looker.WarmCache(ctx, domains)
 }
 
+// Checker is a cached TXT looker-upper and SPF checker. It is safe for
+// concurrent use. Make one with NewSPFChecker or one of its variants; the
+// zero value is not ready for use.
+type Checker struct {
+	// QuerySPFType makes the Checker look for a domain's SPF record among
+	// its records of the obsolete SPF type (99) before its TXT records, as
+	// RFC 4408 did. It only has an effect with a Resolver that implements
+	// SPFTypeResolver, such as DNSClient, and must be set before the
+	// Checker is first used.
+	QuerySPFType bool
+	// Strict makes records with an unknown mechanism a PermError, as RFC
+	// 7208 section 5 requires of them; they are otherwise evaluated
+	// without it. It also rejects records with more than one all
+	// mechanism, as ParseRecord does, which are otherwise evaluated up to
+	// the first. Unknown modifiers are ignored either way. It must be set
+	// before the Checker is first used.
+	Strict bool
+	// MultipleRecords is what becomes of domains publishing more than one
+	// SPF record: by default, a PermError, as RFC 7208 section 4.5
+	// requires. It must be set before the Checker is first used.
+	MultipleRecords MultipleRecordPolicy
+	// AllowedIncludes, if set, are the domains whose records may be
+	// included, along with those of their subdomains, such as the mail
+	// providers an organization has vetted. Includes of other domains,
+	// outside the records of allowed ones, are described in the
+	// Evaluation's Warnings or, with Strict, make the check a PermError
+	// matching ErrUntrustedInclude. It must be set before the Checker is
+	// first used.
+	AllowedIncludes []string
+	// TreatSoftFailAsFail hardens policies that end in ~all, giving Fail
+	// for the checks that would be SoftFail. The mechanism that matched is
+	// reported as written, and the explanation of the record's exp
+	// modifier given as for any Fail. An include's result is unaffected,
+	// since only a Pass matters.
+	TreatSoftFailAsFail bool
+	// Tracer, if set, is told of each step of the Checker's checks. It
+	// must be set before the Checker is first used.
+	Tracer Tracer
+	// MaxDepth is the number of includes and redirects that may be nested
+	// below the checked domain's record before the check is a PermError,
+	// whatever the lookups made so far. Zero is the default of 10, which
+	// the lookup limit never allows to be exceeded anyway.
+	MaxDepth int
+	// MaxEvalDuration, if set, is the time a single check may take, its
+	// DNS lookups included, before it is abandoned as a TempError with
+	// context.DeadlineExceeded.
+	MaxEvalDuration time.Duration
+	// Retries is the number of times a DNS lookup that fails temporarily,
+	// as with a timeout or SERVFAIL, is tried again before the failure is
+	// taken as it is. The first retry is made after RetryDelay, and each
+	// after that waits twice as long as the last; none are made that would
+	// outlast the check's context or MaxEvalDuration. Zero, the default,
+	// tries each lookup once.
+	Retries    int
+	RetryDelay time.Duration
+	// Metrics, if set, is told of the Checker's cache hits and misses, the
+	// DNS lookups it makes and the results of its checks. It must be set
+	// before the Checker is first used.
+	Metrics Metrics
+	// Cache holds the SPF records of the domains checked. The constructors
+	// set it to an in-memory cache, which can be replaced, before the
+	// Checker is first used, by one shared with other processes. A nil
+	// Cache caches nothing.
+	Cache Cache
+	// NegativeTTL is how long domains found to have no SPF record are
+	// remembered as having none, apart from Cache. Zero is the default of
+	// five minutes, and a negative duration remembers nothing. The most
+	// recently found of them are kept, up to the Checker's capacity or, if
+	// it has none, 10000.
+	NegativeTTL time.Duration
+
+	resolver Resolver
+	// generation counts the calls to DumpCache and InvalidateDomain, so that
+	// lookups they overtake are not cached; see store.
+	generation   uint64
+	generationMu sync.RWMutex
+	// flight shares the lookups of each domain's records between the
+	// checks that miss the cache at once.
+	flight singleflight.Group
+	// negative holds the errors for the domains without SPF records.
+	negative *memoryCache
+}
+
+// MultipleRecordPolicy is how a Checker treats a domain publishing more
+// than one SPF record.
+type MultipleRecordPolicy int
+
+const (
+	// MultipleRecordsStrict makes the records an error matching
+	// ErrMultipleRecords, and checks of the domain a PermError.
+	MultipleRecordsStrict MultipleRecordPolicy = iota
+	// MultipleRecordsUseFirst uses the first of the records, as a
+	// stopgap while a domain's records are being merged. DNS servers need
+	// not return records in any order, so which one that is may vary.
+	MultipleRecordsUseFirst
+)
+
+// find locates the SPF record among a domain's TXT records under p.
+func (p MultipleRecordPolicy) find(txtRecords []string) ([]string, error) {
+	spfRs, err := findSPFRecord(txtRecords)
+	if err == ErrMultipleRecords && p == MultipleRecordsUseFirst {
+		for _, record := range txtRecords {
+			if hasSPFVersion(record) {
+				return []string{record}, nil
+			}
+		}
+	}
+	return spfRs, err
+}
+
+// defaultNegativeTTL is how long domains without SPF records are remembered
+// as such by default.
+const defaultNegativeTTL = 5 * time.Minute
+
+// defaultNegativeCapacity is the number of domains without SPF records that
+// are remembered as such, unless a Checker's capacity is set: enough for
+// the domains of a busy server's recent mail, but not for every one a
+// spammer makes up.
+const defaultNegativeCapacity = 10000
+
 // NewSPFChecker returns a SPF looker-upper with an internal cache.
 // You should probably use the library's instance through the top-level functions.
-func NewSPFChecker() *spfChecker {
-	s := new(spfChecker)
-	s.Cache = make(map[string][]string)
+func NewSPFChecker() *Checker {
+	return NewSPFCheckerWithResolver(net.DefaultResolver)
+}
+
+// NewSPFCheckerWithResolver returns a SPF looker-upper with an internal
+// cache, which makes its DNS lookups through the given Resolver.
+func NewSPFCheckerWithResolver(r Resolver) *Checker {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return &Checker{Cache: newMemoryCache(0, 0), resolver: r, negative: newMemoryCache(0, defaultNegativeCapacity)}
+}
+
+// NewSPFCheckerWithTTL returns a SPF looker-upper whose cached records expire
+// after the given duration, so that changes to a domain's policy are seen
+// within it. A duration of zero caches records until the cache is dumped.
+func NewSPFCheckerWithTTL(d time.Duration) *Checker {
+	s := NewSPFChecker()
+	s.Cache = newMemoryCache(d, 0)
 	return s
 }
 
-// DumpCache resets the SPF cache to an empty map.
-func (sc *spfChecker) DumpCache() {
-	sc.Cache = make(map[string][]string)
+// NewSPFCheckerWithCapacity returns a SPF looker-upper that caches the
+// records of at most n domains, evicting the least recently validated when
+// full. An n of zero leaves the cache unbounded.
+func NewSPFCheckerWithCapacity(n int) *Checker {
+	s := NewSPFChecker()
+	s.Cache = newMemoryCache(0, n)
+	if n > 0 {
+		s.negative = newMemoryCache(0, n)
+	}
+	return s
+}
+
+// NewSPFCheckerNoCache returns a SPF looker-upper that caches nothing, so
+// that every check looks its records up afresh, as short-lived tools and
+// tests may want.
+func NewSPFCheckerNoCache() *Checker {
+	s := NewSPFChecker()
+	s.Cache = nil
+	return s
+}
+
+// DumpCache empties the SPF cache. Lookups in progress are not cached once
+// they finish, so that no records fetched before the cache was dumped
+// outlive it; the checks they are for still use them.
+func (sc *Checker) DumpCache() {
+	sc.generationMu.Lock()
+	defer sc.generationMu.Unlock()
+	sc.generation++
+	if sc.Cache != nil {
+		sc.Cache.Dump()
+	}
+	sc.negative.Dump()
+}
+
+// InvalidateDomain removes a domain from the cache, so that its SPF record
+// is looked up again when next needed, leaving those of other domains
+// cached. As with DumpCache, lookups in progress are not cached.
+func (sc *Checker) InvalidateDomain(domain string) {
+	domain = normalizeDomain(domain)
+	sc.generationMu.Lock()
+	defer sc.generationMu.Unlock()
+	sc.generation++
+	if sc.Cache != nil {
+		sc.Cache.Delete(domain)
+	}
+	sc.negative.Delete(domain)
+}
+
+// WarmCache fetches and caches the SPF records of the given domains ahead of
+// their first checks, several at a time. A domain that cannot be looked up
+// does not stop the others being; the errors for each such domain are
+// returned together, joined by errors.Join.
+func (sc *Checker) WarmCache(ctx context.Context, domains []string) error {
+	errs := make([]error, len(domains))
+	sem := make(chan struct{}, maxParallelLookups)
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		go func(i int, domain string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+			}
+			if err := ctx.Err(); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", domain, err)
+				return
+			}
+			if _, err := sc.lookupSPFRecords(ctx, domain); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", domain, err)
+			}
+		}(i, domain)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
 // LookupSPFRecords is a cached lookup for SPF records
-func (sc *spfChecker) LookupSPFRecords(domain string) ([]string, error) {
-	_, ok := sc.Cache[domain]
+func (sc *Checker) LookupSPFRecords(domain string) ([]string, error) {
+	return sc.lookupSPFRecords(context.Background(), domain)
+}
+
+// LookupRecord is a cached lookup of the SPF record a domain publishes. It
+// returns an error matching ErrNoSPFRecords if there is none, and ErrMultipleRecords if there
+// is more than one, unless MultipleRecords is MultipleRecordsUseFirst.
+func (sc *Checker) LookupRecord(domain string) (string, error) {
+	records, err := sc.lookupSPFRecords(context.Background(), domain)
+	if err != nil {
+		return "", err
+	}
+	return records[0], nil
+}
+
+// LookupRecordWithTTL returns the SPF record a domain publishes among its
+// TXT records, and how long it may be cached for, for callers that cache
+// records themselves. The record is always looked up afresh, and is not
+// cached by the Checker. The Checker's resolver must be a TTLResolver, such
+// as DNSClient; others give ErrNoTTLs.
+func (sc *Checker) LookupRecordWithTTL(domain string) (string, time.Duration, error) {
+	tr, ok := sc.resolver.(TTLResolver)
 	if !ok {
-		txtRecords, err := net.LookupTXT(domain)
-		if err != nil {
-			if dnserr, ok := err.(*net.DNSError); ok && (!dnserr.Timeout()) {
-				return nil, ErrNoSPFRecords
-			}
-			return nil, err
+		return "", 0, ErrNoTTLs
+	}
+	domain = normalizeDomain(domain)
+	ctx, cancel := sc.withTimeout(context.Background())
+	defer cancel()
+	if sc.Tracer != nil {
+		sc.Tracer.Lookup("TXT", domain)
+	}
+	if sc.Metrics != nil {
+		sc.Metrics.Lookup("TXT")
+	}
+	var txtRecords []string
+	var ttl time.Duration
+	err := sc.retryPolicy().do(ctx, func() (err error) {
+		txtRecords, ttl, err = tr.LookupTXTWithTTL(ctx, domain)
+		return err
+	})
+	if isNotFound(err) {
+		return "", 0, ErrNoTXTRecords
+	} else if err != nil {
+		return "", 0, err
+	}
+	spfRs, err := sc.MultipleRecords.find(txtRecords)
+	if err != nil {
+		return "", 0, err
+	}
+	return spfRs[0], ttl, nil
+}
+
+// cached returns the cached SPF records of a domain and their DNSSEC status,
+// which only the built-in cache keeps, or the error for a domain remembered
+// as having none.
+func (sc *Checker) cached(domain string) ([]string, DNSSECStatus, bool, error) {
+	if sc.Cache == nil {
+		return nil, DNSSECUnknown, false, nil
+	}
+	if mc, ok := sc.Cache.(*memoryCache); ok {
+		if entry, ok := mc.get(domain); ok {
+			return entry.records, entry.dnssec, true, nil
 		}
-		if txtRecords == nil || len(txtRecords) == 0 {
-			return nil, ErrNoSPFRecords
+	} else if records, ok := sc.Cache.Get(domain); ok {
+		return records, DNSSECUnknown, true, nil
+	}
+	if entry, ok := sc.negative.get(domain); ok {
+		return nil, DNSSECUnknown, true, entry.err
+	}
+	return nil, DNSSECUnknown, false, nil
+}
+
+// cacheGeneration returns the generation of the cache, to be passed to
+// store by a lookup about to start.
+func (sc *Checker) cacheGeneration() uint64 {
+	sc.generationMu.RLock()
+	defer sc.generationMu.RUnlock()
+	return sc.generation
+}
+
+// store caches the outcome of a lookup started in the given generation of
+// the cache, unless the cache has been dumped or invalidated since.
+func (sc *Checker) store(generation uint64, store func()) {
+	sc.generationMu.RLock()
+	defer sc.generationMu.RUnlock()
+	if sc.generation == generation {
+		store()
+	}
+}
+
+// storeNegative remembers that a domain has no SPF record, for
+// NegativeTTL, as found by a lookup started in the given generation.
+func (sc *Checker) storeNegative(generation uint64, domain string, err error) error {
+	ttl := sc.NegativeTTL
+	if ttl == 0 {
+		ttl = defaultNegativeTTL
+	}
+	if sc.Cache != nil && ttl > 0 {
+		sc.store(generation, func() {
+			sc.negative.put(&cacheEntry{domain: domain, err: err, expires: now().Add(ttl)})
+		})
+	}
+	return err
+}
+
+func (sc *Checker) lookupSPFRecords(ctx context.Context, domain string) ([]string, error) {
+	spfRs, _, err := sc.lookupPolicy(ctx, domain)
+	return spfRs, err
+}
+
+// lookupPolicy is lookupSPFRecords, also returning the DNSSEC status of the
+// records.
+func (sc *Checker) lookupPolicy(ctx context.Context, domain string) ([]string, DNSSECStatus, error) {
+	// Every form of a domain's name shares its cache entry.
+	domain = normalizeDomain(domain)
+	if spfRs, dnssec, ok, err := sc.cached(domain); ok {
+		if sc.Metrics != nil {
+			sc.Metrics.CacheHit()
 		}
-		spfRs, err := findSPFRecord(txtRecords)
-		if err != nil {
-			return nil, err
+		return spfRs, dnssec, err
+	}
+	if sc.Metrics != nil {
+		sc.Metrics.CacheMiss()
+	}
+	// Concurrent checks of a domain share a single lookup of its records,
+	// made under the context of the first of them. Those that start after
+	// the cache is dumped or invalidated do not join a lookup from before.
+	generation := sc.cacheGeneration()
+	key := fmt.Sprintf("%d/%s", generation, domain)
+	ch := sc.flight.DoChan(key, func() (interface{}, error) {
+		spfRs, dnssec, err := sc.fetchPolicy(ctx, generation, domain)
+		return policyAnswer{spfRs, dnssec, err != nil && ctx.Err() != nil}, err
+	})
+	select {
+	case res := <-ch:
+		answer := res.Val.(policyAnswer)
+		if answer.abandoned && ctx.Err() == nil {
+			// The check that made the lookup gave up on it, where this one
+			// has not.
+			return sc.fetchPolicy(ctx, generation, domain)
 		}
-		if spfRs == nil || len(spfRs) == 0 {
-			return nil, ErrNoSPFRecords
+		return answer.records, answer.dnssec, res.Err
+	case <-ctx.Done():
+		return nil, DNSSECUnknown, ctx.Err()
+	}
+}
+
+// policyAnswer is the outcome of fetchPolicy, as shared between the checks
+// waiting on it.
+type policyAnswer struct {
+	records []string
+	dnssec  DNSSECStatus
+	// abandoned is set if the lookup failed for its context being done.
+	abandoned bool
+}
+
+// fetchPolicy looks up a domain's SPF records, missing the cache, and
+// caches them unless the cache has left the given generation.
+func (sc *Checker) fetchPolicy(ctx context.Context, generation uint64, domain string) ([]string, DNSSECStatus, error) {
+	var txtRecords []string
+	var dnssec DNSSECStatus
+	err := sc.retryPolicy().do(ctx, func() (err error) {
+		txtRecords, dnssec, err = lookupPolicyRecords(ctx, sc.resolver, domain, sc.QuerySPFType, sc.Tracer, sc.Metrics)
+		return err
+	})
+	if err != nil {
+		// Only a name without records means there is no policy; timeouts
+		// and server failures may clear up, and are left for the caller
+		// to treat as a TempError.
+		if isNotFound(err) {
+			return nil, DNSSECUnknown, sc.storeNegative(generation, domain, ErrNoTXTRecords)
 		}
-		sc.Cache[domain] = spfRs
+		return nil, DNSSECUnknown, err
+	}
+	if txtRecords == nil || len(txtRecords) == 0 {
+		return nil, DNSSECUnknown, sc.storeNegative(generation, domain, ErrNoTXTRecords)
+	}
+	spfRs, err := sc.MultipleRecords.find(txtRecords)
+	if err == ErrNoSPFRecordInTXT {
+		return nil, DNSSECUnknown, sc.storeNegative(generation, domain, err)
+	} else if err != nil {
+		return nil, DNSSECUnknown, err
+	}
+	if spfRs == nil || len(spfRs) == 0 {
+		return nil, DNSSECUnknown, sc.storeNegative(generation, domain, ErrNoSPFRecordInTXT)
 	}
-	return sc.Cache[domain], nil
+	sc.store(generation, func() {
+		if mc, ok := sc.Cache.(*memoryCache); ok {
+			mc.set(domain, spfRs, dnssec)
+		} else if sc.Cache != nil {
+			sc.Cache.Set(domain, spfRs)
+		}
+	})
+	return spfRs, dnssec, nil
 }
 
 // Validate returns whether an IP is allowed to post from a given domain.
 // If no SPF records are found and it's believed not to be a DNS timeout,
 // the default is True.
-func (sc *spfChecker) Validate(ip, domain string) (bool, error) {
-	spfRecordList, err := sc.LookupSPFRecords(domain)
-	if err != nil {
-		if err == ErrNoSPFRecords {
-			return true, nil
+func (sc *Checker) Validate(ip, domain string) (bool, error) {
+	res, err := sc.ValidateResult(ip, domain)
+	return res == Pass || res == None, err
+}
+
+// ValidateResult returns the SPF result for an IP posting from a given domain.
+// A domain without SPF records yields None. TempError and PermError are
+// accompanied by the error that caused them; an IP that cannot be parsed is
+// a PermError, with an error matching ErrInvalidIP.
+func (sc *Checker) ValidateResult(ip, domain string) (Result, error) {
+	return sc.ValidateContext(context.Background(), ip, domain)
+}
+
+// ValidateContext is ValidateResult with a context governing the DNS lookups.
+// If the context is done before the check completes, the result is TempError
+// alongside the context's error.
+func (sc *Checker) ValidateContext(ctx context.Context, ip, domain string) (Result, error) {
+	ev, err := sc.CheckContext(ctx, ip, domain)
+	return ev.Result, err
+}
+
+// ValidateIP is ValidateResult for an IP that has already been parsed. An
+// invalid IP yields PermError alongside ErrInvalidIP.
+func (sc *Checker) ValidateIP(ip net.IP, domain string) (Result, error) {
+	ev, err := sc.check(context.Background(), ip, domain, "postmaster@"+domain, "")
+	return ev.Result, err
+}
+
+// ValidateAnyIP is ValidateResult for a message that may have been sent
+// from any of several IPs, as when it was passed through several relays. It
+// returns the first IP whose result is Pass, along with that result. The
+// domain's record is looked up once, and the lookups of its mechanisms are
+// shared between the IPs. If none pass, the result and error are those of
+// the first IP, and no IP is returned.
+func (sc *Checker) ValidateAnyIP(ips []string, domain string) (Result, string, error) {
+	if len(ips) == 0 {
+		return PermError, "", fmt.Errorf("%w: no IPs given", ErrInvalidIP)
+	}
+	clientIPs := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		clientIP, err := parseClientIP(ip)
+		if err != nil {
+			return PermError, "", err
 		}
-		return false, err
+		clientIPs[i] = clientIP
 	}
-	spfRecord := spfRecordList[0]
-	splitSPFRecord := strings.Split(spfRecord, " ")
-	allRecord := splitSPFRecord[len(splitSPFRecord)-1]
-	allRecordSplit := strings.Split(allRecord, "a")
-	allRecord = allRecordSplit[0]
-
-	ips, err := getIPsForRecord(domain, spfRecord)
-	if err != nil {
-		return false, err
-	}
-
-  // TODO Does this need IPv6 modernisation? Not clear what's happening with the
-	// mask suffixing.
-	for _, element := range ips {
-		elementWithCidr := element
-		if !strings.Contains(elementWithCidr, "/") {
-			if !strings.Contains(elementWithCidr, ":") {
-				elementWithCidr = elementWithCidr + "/32" // fmt.Sprintf("%s/32", elementWithCidr)
-			} else {
-				elementWithCidr = elementWithCidr + "/128" // fmt.Sprintf("%s/128", elementWithCidr)
+	ctx, cancel := sc.withTimeout(context.Background())
+	defer cancel()
+	record, _, ev, err := sc.policy(ctx, domain)
+	if ev == nil {
+		dns := sc.newPrefetcher()
+		for i, ip := range clientIPs {
+			ipEv, ipErr := sc.evaluateWith(ctx, dns, ip, domain, record, "postmaster@"+domain, "")
+			if ipEv.Result == Pass {
+				if sc.Metrics != nil {
+					sc.Metrics.Outcome(Pass)
+				}
+				return Pass, ips[i], ipErr
+			}
+			if i == 0 {
+				ev, err = ipEv, ipErr
 			}
 		}
-		_, cidrnet, err := net.ParseCIDR(elementWithCidr)
-		if err != nil {
-			return false, err
+	}
+	if sc.Metrics != nil {
+		sc.Metrics.Outcome(ev.Result)
+	}
+	return ev.Result, "", err
+}
+
+// ValidateRecord is ValidateResult for a domain whose SPF record is given,
+// rather than looked up: a record yet to be published, or one fetched some
+// other way. The record's includes, redirects and other mechanisms are still
+// looked up through DNS. A malformed record yields PermError.
+func (sc *Checker) ValidateRecord(ip, domain, record string) (Result, error) {
+	clientIP, err := parseClientIP(ip)
+	if err != nil {
+		return PermError, err
+	}
+	ctx, cancel := sc.withTimeout(context.Background())
+	defer cancel()
+	ev, err := sc.evaluate(ctx, clientIP, domain, record, "postmaster@"+domain, "")
+	if sc.Metrics != nil {
+		sc.Metrics.Outcome(ev.Result)
+	}
+	return ev.Result, err
+}
+
+// Evaluate evaluates a domain's SPF record, already fetched and parsed, for
+// a message from sender, sent by the given IP that introduced itself with
+// the given HELO identity. An empty sender is the null sender, which is
+// postmaster@ the domain, as it is for a bounce whose HELO identity is
+// checked. It is the check at the heart of every other, with the Checker's
+// settings but not its cache: the lookups of the record's mechanisms,
+// includes and redirect are the only DNS lookups made. As the record did
+// not come through DNS, its DNSSEC status is at best DNSSECUnknown. The
+// returned Evaluation is never nil, even alongside an error.
+func (sc *Checker) Evaluate(ctx context.Context, rec *Record, ip net.IP, domain, sender, helo string) (ev *Evaluation, err error) {
+	if sc.Metrics != nil {
+		defer func() { sc.Metrics.Outcome(ev.Result) }()
+	}
+	ctx, cancel := sc.withTimeout(ctx)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return &Evaluation{Result: TempError}, err
+	}
+	if ip.To16() == nil {
+		return &Evaluation{Result: PermError}, ErrInvalidIP
+	}
+	if sender == "" {
+		sender = domain
+	}
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	ev, err = sc.evaluateRecord(ctx, sc.newPrefetcher(), ip, domain, rec, sender, helo)
+	ev.DNSSEC = DNSSECUnknown.and(ev.DNSSEC)
+	return ev, err
+}
+
+// Explain is ValidateResult, along with a sentence describing how the result
+// was reached, for logging: the mechanism that matched, or those that did
+// not, or the error that ended the check.
+func (sc *Checker) Explain(ip, domain string) (Result, string, error) {
+	ev, err := sc.Check(ip, domain)
+	return ev.Result, ev.describe(ip, domain, err), err
+}
+
+// Check returns the detailed SPF evaluation for an IP posting from a given
+// domain. The returned Evaluation is never nil, even alongside an error.
+func (sc *Checker) Check(ip, domain string) (*Evaluation, error) {
+	return sc.CheckContext(context.Background(), ip, domain)
+}
+
+// CheckContext is Check with a context governing the DNS lookups.
+func (sc *Checker) CheckContext(ctx context.Context, ip, domain string) (*Evaluation, error) {
+	clientIP, err := parseClientIP(ip)
+	if err != nil {
+		return &Evaluation{Result: PermError}, err
+	}
+	return sc.check(ctx, clientIP, domain, "postmaster@"+domain, "")
+}
+
+// ValidateMailFrom returns the SPF result for a message from the given MAIL
+// FROM address, sent from an IP that introduced itself with the given HELO
+// identity. The domain checked is that of mailFrom, or the HELO identity if
+// mailFrom is empty, as it is for bounces. Both identities are available to
+// the record's macros. A missing or malformed domain yields None.
+func (sc *Checker) ValidateMailFrom(ip, helo, mailFrom string) (Result, error) {
+	helo = strings.TrimSpace(helo)
+	sender := strings.TrimSpace(strings.Trim(strings.TrimSpace(mailFrom), "<>"))
+	if sender == "" {
+		// The null sender of a bounce is postmaster@ the HELO identity,
+		// per RFC 7208 section 2.4.
+		sender = helo
+	}
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	_, domain := splitSender(sender)
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.Contains(domain, "..") {
+		return None, nil
+	}
+	clientIP, err := parseClientIP(ip)
+	if err != nil {
+		return PermError, err
+	}
+	ev, err := sc.check(context.Background(), clientIP, domain, sender, helo)
+	return ev.Result, err
+}
+
+// ValidateHELO returns the SPF result for the HELO identity a client
+// introduced itself with, checked on its own as RFC 7208 section 2.3
+// recommends, whatever the envelope sender: the HELO name is the domain,
+// and postmaster@ it the sender of the %{s} macros. An address literal, or
+// a name that is not a multi-label domain name, yields None.
+func (sc *Checker) ValidateHELO(ip, helo string) (Result, error) {
+	helo = strings.TrimSpace(helo)
+	if !strings.Contains(strings.Trim(helo, "."), ".") || strings.HasPrefix(helo, "[") || net.ParseIP(helo) != nil {
+		return None, nil
+	}
+	return sc.ValidateMailFrom(ip, helo, "")
+}
+
+// ValidateSender returns the SPF result for a message from the given
+// envelope sender, for when the HELO identity is not known. Unlike
+// Validate, which checks a domain on behalf of its postmaster, the sender's
+// local part is kept for the %{l} and %{s} macros of per-user policies.
+func (sc *Checker) ValidateSender(ip, sender string) (Result, error) {
+	return sc.ValidateMailFrom(ip, "", sender)
+}
+
+// parseClientIP parses the IP of an SMTP client. An invalid IP is an error
+// matching ErrInvalidIP.
+func parseClientIP(ip string) (net.IP, error) {
+	clientIP := net.ParseIP(strings.TrimSpace(ip))
+	if clientIP == nil {
+		return nil, fmt.Errorf("%w %q", ErrInvalidIP, ip)
+	}
+	return clientIP, nil
+}
+
+// withTimeout returns a context for a check, which is done once the
+// check's MaxEvalDuration has passed.
+func (sc *Checker) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sc.MaxEvalDuration > 0 {
+		return context.WithTimeout(ctx, sc.MaxEvalDuration)
+	}
+	return context.WithCancel(ctx)
+}
+
+// check evaluates the SPF policy of a domain for a message from sender.
+func (sc *Checker) check(ctx context.Context, ip net.IP, domain, sender, helo string) (ev *Evaluation, err error) {
+	if sc.Metrics != nil {
+		defer func() { sc.Metrics.Outcome(ev.Result) }()
+	}
+	ctx, cancel := sc.withTimeout(ctx)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return &Evaluation{Result: TempError}, err
+	}
+	if ip.To16() == nil {
+		return &Evaluation{Result: PermError}, ErrInvalidIP
+	}
+	record, dnssec, ev, err := sc.policy(ctx, domain)
+	if ev != nil {
+		return ev, err
+	}
+	ev, err = sc.evaluate(ctx, ip, domain, record, sender, helo)
+	ev.DNSSEC = dnssec.and(ev.DNSSEC)
+	return ev, err
+}
+
+// policy returns the SPF record of a domain to be evaluated and its DNSSEC
+// status or, where there is none that can be, the evaluation that results.
+func (sc *Checker) policy(ctx context.Context, domain string) (string, DNSSECStatus, *Evaluation, error) {
+	spfRecordList, dnssec, err := sc.lookupPolicy(ctx, domain)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", DNSSECUnknown, &Evaluation{Result: TempError}, ctx.Err()
 		}
-		ipAddress := net.ParseIP(ip)
-		if cidrnet.Contains(ipAddress) {
-			return true, nil
+		switch {
+		case errors.Is(err, ErrNoSPFRecords):
+			return "", DNSSECUnknown, &Evaluation{Result: None}, nil
+		case err == ErrMultipleRecords, errors.Is(err, ErrCNAMELoop):
+			return "", DNSSECUnknown, &Evaluation{Result: PermError}, err
 		}
+		return "", DNSSECUnknown, &Evaluation{Result: TempError}, err
 	}
-	return false, nil
+	return spfRecordList[0], dnssec, nil, nil
 }
 
-// GetDomainFromEmail returns the domain name from an email address. It is
-// somewhat naive at present.
-func GetDomainFromEmail(email string) (string, error) {
-	parsed, err := mail.ParseAddress(email)
+// evaluate evaluates a domain's SPF record for a message from sender.
+func (sc *Checker) evaluate(ctx context.Context, ip net.IP, domain, record, sender, helo string) (*Evaluation, error) {
+	// Lookups started ahead of need are abandoned once the check is done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return sc.evaluateWith(ctx, sc.newPrefetcher(), ip, domain, record, sender, helo)
+}
+
+// evaluateWith is evaluate, making its lookups through dns, which may be
+// shared with other evaluations made before ctx is done.
+func (sc *Checker) evaluateWith(ctx context.Context, dns *prefetcher, ip net.IP, domain, record, sender, helo string) (*Evaluation, error) {
+	rec, err := parseRecord(record, !sc.Strict)
 	if err != nil {
-		return "", err
+		return &Evaluation{Result: PermError}, err
 	}
-	return processEmail(strings.ToLower(strings.TrimSpace(parsed.Address)))
+	return sc.evaluateRecord(ctx, dns, ip, domain, rec, sender, helo)
 }
 
-// == Everything Under Here Unmodified from Original ==
+// evaluateRecord is evaluateWith, for a parsed record.
+func (sc *Checker) evaluateRecord(ctx context.Context, dns *prefetcher, ip net.IP, domain string, rec *Record, sender, helo string) (*Evaluation, error) {
+	// Macros expand to the domains in the form they are looked up in.
+	domain = normalizeDomain(domain)
+	helo = normalizeDomain(helo)
+	local, senderDomain := splitSender(sender)
+	sender = local + "@" + normalizeDomain(senderDomain)
+	// An IPv4-mapped IPv6 address, as presented by some dual-stack proxies,
+	// is the IPv4 client it maps.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	e := sc.newEvaluator(ctx, dns, ip, sender, helo)
+	res, explanation, err := e.checkHost(domain, rec)
+	if err != nil && ctx.Err() != nil {
+		return &Evaluation{Result: TempError}, ctx.Err()
+	}
+	ev := &Evaluation{Result: res, Explanation: explanation, Matched: e.matched, EvaluatedDomain: e.evaluated, Unmatched: e.tried, DNSSEC: e.dnssec, Warnings: e.warnings}
+	if e.matched != "" {
+		ev.Trace = e.trace
+	}
+	return ev, err
+}
 
-//Splits an email address into "username" and "domain" parts. It gives back the domain name.
-func processEmail(email string) (string, error) {
-	splitEmail := strings.Split(email, "@")
-	if len(splitEmail) != 2 {
-		return "", errors.New("Email address either has not enough or too many @ symbols")
+// newEvaluator returns an evaluator for a check on behalf of a sender, which
+// introduced itself with the given HELO identity, with the Checker's
+// settings, making its lookups through dns.
+func (sc *Checker) newEvaluator(ctx context.Context, dns *prefetcher, ip net.IP, sender, helo string) *evaluator {
+	e := newEvaluator(ctx, dns, ip, sender, helo)
+	e.spfType = sc.QuerySPFType
+	e.strict = sc.Strict
+	e.multiple = sc.MultipleRecords
+	e.allowedIncludes = sc.AllowedIncludes
+	e.softFailAsFail = sc.TreatSoftFailAsFail
+	e.tracer = sc.Tracer
+	if sc.MaxDepth > 0 {
+		e.maxDepth = sc.MaxDepth
 	}
-	domain := splitEmail[1]
-	return domain, nil
+	return e
 }
 
-//Locates the SPF record in the txt records, and returns the record as long as there aren't too many.
-func findSPFRecord(txtRecords []string) ([]string, error) {
-	var spfRecords []string
-	for _, record := range txtRecords {
-		if strings.HasPrefix(record, "v=spf1") {
-			spfRecords = append(spfRecords, record)
+// newPrefetcher returns a prefetcher for the lookups of a check, or of
+// several sharing them, traced, counted and retried as the Checker's
+// settings say.
+func (sc *Checker) newPrefetcher() *prefetcher {
+	p := newPrefetcher(sc.resolver)
+	p.tracer = sc.Tracer
+	p.metrics = sc.Metrics
+	p.retry = sc.retryPolicy()
+	return p
+}
+
+// GetDomainFromEmail returns the domain name from an email address, which
+// may have a display name, as in "Name <local@domain>". A list of addresses
+// is an error matching ErrMultipleAddresses, but an address that net/mail
+// rejects for a malformed display name is still read where its domain can
+// be found.
+func GetDomainFromEmail(email string) (string, error) {
+	// net/mail does not accept the trailing dot of a fully-qualified domain.
+	email = strings.TrimSpace(email)
+	if email == "" || email == "<>" {
+		return "", ErrNullSender
+	}
+	if strings.HasSuffix(email, ".>") {
+		email = strings.TrimSuffix(email, ".>") + ">"
+	} else {
+		email = strings.TrimSuffix(email, ".")
+	}
+	address, err := singleAddress(email)
+	if err != nil {
+		return "", err
+	}
+	domain, err := processEmail(strings.ToLower(strings.TrimSpace(address)))
+	if err != nil {
+		return "", err
+	}
+	return normalizeDomain(domain), nil
+}
+
+// singleAddress returns the address of an email address, which may have a
+// display name or be the only member of a group.
+func singleAddress(email string) (string, error) {
+	list, err := mail.ParseAddressList(email)
+	if err == nil {
+		if len(list) != 1 {
+			return "", ErrMultipleAddresses
 		}
+		return list[0].Address, nil
 	}
-	if len(spfRecords) == 0 || len(spfRecords) > 1 {
-		return []string{}, errors.New("Too many SPF records found")
+	// Display names that net/mail rejects, such as those with unquoted
+	// commas or dots, still leave the address between angle brackets.
+	address := email
+	if open := strings.LastIndexByte(email, '<'); open >= 0 && strings.HasSuffix(email, ">") {
+		address = email[open+1 : len(email)-1]
 	}
-	return spfRecords, nil
+	address = strings.TrimSpace(address)
+	at := strings.LastIndexByte(address, '@')
+	if at <= 0 || at == len(address)-1 || strings.ContainsAny(address, " \t<>,;:") {
+		return "", err
+	}
+	return address, nil
 }
 
-func getIPsForRecord(domain string, record string) ([]string, error) {
-	var spfSections []string
-	var cidrIPs []string
-	splitTextRecords := strings.Split(record, " ")
-	for _, element := range splitTextRecords {
-		spfSections = append(spfSections, element)
-	}
-	for _, element := range spfSections {
-		if strings.HasPrefix("v=spf1", element) {
-			continue
-		} else if strings.HasPrefix(element, "ip4") {
-			cidr := strings.Replace(element, "ip4:", "", -1)
-			cidrIPs = append(cidrIPs, cidr)
-			continue
-		} else if strings.HasPrefix(element, "include") {
-			record := strings.Replace(element, "include:", "", -1)
-			txtRecords, err := net.LookupTXT(record)
-			if err != nil {
-				return []string{}, err
-			}
-			spfRecordList, err := findSPFRecord(txtRecords)
-			if err != nil {
-				return []string{}, err
+// normalizeDomain returns a domain name in the form it is looked up in:
+// without the trailing dot of a fully-qualified name, and, if it has
+// internationalized labels, lower-cased with those labels as A-labels
+// (punycode). ASCII names, including those already punycoded, are left as
+// they are.
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	for _, c := range domain {
+		if c >= utf8.RuneSelf {
+			// A-labels are made from lower case U-labels.
+			if ascii, err := idna.ToASCII(strings.ToLower(domain)); err == nil {
+				return ascii
 			}
-			spfRecord := spfRecordList[0]
-			recursiveList, err := getIPsForRecord(record, spfRecord)
-			for _, element := range recursiveList {
-				cidrIPs = append(cidrIPs, element)
-			}
-			continue
-		} else if strings.ToLower(element) == "a" || strings.ToLower(element) == "mx" {
-			otherRecord, err := parseOtherRecord(domain, element)
-			if err != nil {
-				return []string{}, err
-			}
-			for _, element := range otherRecord {
-				cidrIPs = append(cidrIPs, element)
-			}
-			continue
-		} else {
-			continue
+			break
 		}
 	}
-	return cidrIPs, nil
+	return domain
 }
 
-func parseOtherRecord(domain string, record string) ([]string, error) {
-	var ipList []string
-	if record == "a" {
-		ip, err := net.LookupIP(domain)
-		if err != nil {
-			return []string{}, err
-		}
-		for _, element := range ip {
-			ipList = append(ipList, element.String())
-		}
-		return ipList, nil
-	} else if record == "mx" {
-		ip, err := net.LookupMX(domain)
-		if err != nil {
-			return []string{}, err
-		}
-		for _, element := range ip {
-			MXARecords, err := parseOtherRecord(element.Host, "a")
-			if err != nil {
-				return []string{}, err
-			}
-			for _, listElement := range MXARecords {
-				ipList = append(ipList, listElement)
-			}
+// processEmail returns the domain of an email address: what follows its
+// last @, since a quoted local part may hold @s of its own.
+func processEmail(email string) (string, error) {
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return "", errors.New("Email address has no @ symbol")
+	}
+	return email[at+1:], nil
+}
 
+//Locates the SPF record in the txt records, and returns the record as long as there aren't too many.
+func findSPFRecord(txtRecords []string) ([]string, error) {
+	var spfRecords []string
+	for _, record := range txtRecords {
+		if hasSPFVersion(record) {
+			spfRecords = append(spfRecords, record)
 		}
-		return ipList, nil
 	}
-	return []string{}, errors.New("Unknown Record for SPF")
+	if len(spfRecords) == 0 {
+		return []string{}, ErrNoSPFRecordInTXT
+	}
+	if len(spfRecords) > 1 {
+		return []string{}, ErrMultipleRecords
+	}
+	return spfRecords, nil
 }
@@ -0,0 +1,1581 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkRecord evaluates a domain's SPF record against the client IP, with
+// the domain's postmaster as the sender, through a resolver without any
+// records.
+func checkRecord(ip, domain, spfRecord string) (Result, string, error) {
+	rec, err := parseRecord(spfRecord, true)
+	if err != nil {
+		return PermError, "", err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := newEvaluator(ctx, newPrefetcher(&fakeResolver{}), net.ParseIP(ip), "postmaster@"+domain, "")
+	return e.checkHost(domain, rec)
+}
+
+func checkResult(t *testing.T, expected Result, ip, record string) {
+	res, _, err := checkRecord(ip, "example.com", record)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res, "%s against %q", ip, record)
+}
+
+func TestQualifiers(t *testing.T) {
+	checkResult(t, Pass, "1.2.3.4", "v=spf1 ip4:1.2.3.4")
+	checkResult(t, Pass, "1.2.3.4", "v=spf1 +ip4:1.2.3.4")
+	checkResult(t, Fail, "1.2.3.4", "v=spf1 -ip4:1.2.3.4")
+	checkResult(t, SoftFail, "1.2.3.4", "v=spf1 ~ip4:1.2.3.4")
+	checkResult(t, Neutral, "1.2.3.4", "v=spf1 ?ip4:1.2.3.4")
+	// Order and qualifier together determine the outcome.
+	checkResult(t, Pass, "1.2.3.4", "v=spf1 ip4:1.2.3.0/24 -ip4:1.2.3.4")
+	checkResult(t, Fail, "1.2.3.4", "v=spf1 -ip4:1.2.3.4 ip4:1.2.3.0/24")
+	checkResult(t, Pass, "1.2.3.5", "v=spf1 -ip4:1.2.3.4 ip4:1.2.3.0/24")
+}
+
+func TestFirstMatchWins(t *testing.T) {
+	record := "v=spf1 ip4:10.1.0.0/16 -ip4:10.0.0.0/8 ip4:10.2.0.1"
+	checkResult(t, Pass, "10.1.2.3", record)
+	checkResult(t, Fail, "10.2.0.1", record)
+	checkResult(t, Neutral, "192.0.2.1", record)
+	// A malformed mechanism anywhere in the record is a PermError, even
+	// after one that matches.
+	res, _, err := checkRecord("10.1.2.3", "example.com", "v=spf1 ip4:10.1.0.0/16 ip4:not-a-network")
+	assert.NotNil(t, err)
+	assert.Equal(t, PermError, res)
+}
+
+func TestIP6(t *testing.T) {
+	record := "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -ip6:2001:db9::1"
+	checkResult(t, Pass, "2001:db8::25", record)
+	checkResult(t, Pass, "2001:db8:ffff::1", record)
+	checkResult(t, Fail, "2001:db9::1", record)
+	checkResult(t, Neutral, "2001:db9::2", record)
+	checkResult(t, Pass, "192.0.2.7", record)
+	// Neither family matches the other's mechanisms.
+	checkResult(t, Neutral, "192.0.2.7", "v=spf1 ip6:::/0")
+	checkResult(t, Neutral, "2001:db8::25", "v=spf1 ip4:0.0.0.0/0")
+}
+
+func TestAll(t *testing.T) {
+	checkResult(t, Fail, "192.0.2.1", "v=spf1 -all")
+	checkResult(t, SoftFail, "192.0.2.1", "v=spf1 ~all")
+	checkResult(t, Neutral, "192.0.2.1", "v=spf1 ?all")
+	checkResult(t, Pass, "192.0.2.1", "v=spf1 +all")
+	checkResult(t, Pass, "192.0.2.1", "v=spf1 all")
+	checkResult(t, Fail, "192.0.2.1", "v=spf1 ip4:198.51.100.0/24 -all")
+	checkResult(t, Pass, "198.51.100.3", "v=spf1 ip4:198.51.100.0/24 -all")
+	checkResult(t, SoftFail, "2001:db8::1", "v=spf1 ip4:198.51.100.0/24 ~all")
+}
+
+func TestLookupLimit(t *testing.T) {
+	// An include chain of depth n looks up n records.
+	chain := func(n int) map[string][]string {
+		txt := map[string][]string{}
+		for i := 0; i < n; i++ {
+			txt[fmt.Sprintf("%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 include:%d.example.com", i+1)}
+		}
+		txt[fmt.Sprintf("%d.example.com", n)] = []string{"v=spf1 ip4:192.0.2.1"}
+		return txt
+	}
+	sc, _ := fakeChecker(chain(10))
+	res, err := sc.ValidateResult("192.0.2.1", "0.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	sc, _ = fakeChecker(chain(11))
+	res, err = sc.ValidateResult("192.0.2.1", "0.example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, PermError, res)
+
+	sc, _ = fakeChecker(map[string][]string{
+		"example.com": {"v=spf1" + strings.Repeat(" exists:nothing.example.com", 11) + " -all"},
+	})
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, PermError, res)
+}
+
+func TestRedirect(t *testing.T) {
+	txt := map[string][]string{
+		"example.com":         {"v=spf1 ip4:192.0.2.0/24 redirect=_spf.example.com"},
+		"_spf.example.com":    {"v=spf1 ip4:198.51.100.0/24 -all"},
+		"all.example.com":     {"v=spf1 ?all redirect=_spf.example.com"},
+		"missing.example.com": {"v=spf1 redirect=nothing.example.com"},
+		"loop.example.com":    {"v=spf1 redirect=loop2.example.com"},
+		"loop2.example.com":   {"v=spf1 redirect=loop.example.com"},
+	}
+	// A chain of redirects longer than the lookup limit.
+	for i := 0; i < 11; i++ {
+		txt[fmt.Sprintf("%d.chain.example.com", i)] = []string{fmt.Sprintf("v=spf1 redirect=%d.chain.example.com", i+1)}
+	}
+	txt["11.chain.example.com"] = []string{"v=spf1 +all"}
+	sc, _ := fakeChecker(txt)
+	for _, c := range []struct {
+		ip, domain string
+		expected   Result
+		err        error
+	}{
+		// The record redirected to decides what the mechanisms do not.
+		{"192.0.2.1", "example.com", Pass, nil},
+		{"198.51.100.1", "example.com", Pass, nil},
+		{"203.0.113.1", "example.com", Fail, nil},
+		// An all leaves nothing for the redirect to decide.
+		{"198.51.100.1", "all.example.com", Neutral, nil},
+		{"192.0.2.1", "missing.example.com", PermError, ErrNoTXTRecords},
+		{"192.0.2.1", "loop.example.com", PermError, ErrLoop},
+		{"192.0.2.1", "0.chain.example.com", PermError, ErrTooManyLookups},
+		{"192.0.2.1", "2.chain.example.com", Pass, nil},
+	} {
+		res, err := sc.ValidateResult(c.ip, c.domain)
+		assert.Equal(t, c.expected, res, "%s from %s", c.domain, c.ip)
+		if c.err == nil {
+			assert.Nil(t, err, "%s from %s", c.domain, c.ip)
+		} else {
+			assert.True(t, errors.Is(err, c.err), "%s: %v", c.domain, err)
+		}
+	}
+}
+
+func TestRedirectLookupLimit(t *testing.T) {
+	// Each redirect is a lookup of its own, and the records redirected to
+	// share the budget of the record redirecting to them, per RFC 7208
+	// section 4.6.4: here 3 redirects and 8 a mechanisms make 11 lookups.
+	sc, f := fakeChecker(map[string][]string{
+		"0.example.com": {"v=spf1 a:x.example.com a:x.example.com a:x.example.com redirect=1.example.com"},
+		"1.example.com": {"v=spf1 a:x.example.com a:x.example.com a:x.example.com redirect=2.example.com"},
+		"2.example.com": {"v=spf1 a:x.example.com redirect=3.example.com"},
+		"3.example.com": {"v=spf1 a:x.example.com ip4:192.0.2.1"},
+	})
+	f.ip = map[string][]net.IP{"x.example.com": {net.ParseIP("198.51.100.1")}}
+	res, err := sc.ValidateResult("192.0.2.1", "0.example.com")
+	assert.Equal(t, PermError, res)
+	assert.True(t, errors.Is(err, ErrTooManyLookups), "%v", err)
+
+	// One fewer lookup is within the limit.
+	res, err = sc.ValidateResult("192.0.2.1", "1.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+}
+
+func TestIncludeLoops(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"a.example.com":    {"v=spf1 include:b.example.com -all"},
+		"b.example.com":    {"v=spf1 include:A.example.com. -all"},
+		"self.example.com": {"v=spf1 redirect=self.example.com"},
+		"rd.example.com":   {"v=spf1 redirect=a.example.com"},
+		"twice.example.com": {"v=spf1 include:c.example.com include:c.example.com " +
+			"include:d.example.com ip4:192.0.2.1 -all"},
+		"c.example.com": {"v=spf1 ip4:198.51.100.1 -all"},
+		"d.example.com": {"v=spf1 include:c.example.com"},
+	})
+	for _, domain := range []string{"a.example.com", "self.example.com", "rd.example.com"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Equal(t, PermError, res, domain)
+		if assert.NotNil(t, err, domain) {
+			assert.Contains(t, err.Error(), "includes itself", domain)
+		}
+	}
+
+	// Including a record twice is not a loop, and each record is only
+	// fetched once.
+	atomic.StoreInt32(&f.queries, 0)
+	res, err := sc.ValidateResult("192.0.2.1", "twice.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&f.queries))
+}
+
+func TestVoidLookupLimit(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"two.example.com":   {"v=spf1 exists:a.example.com ptr ip4:192.0.2.1 -all"},
+		"three.example.com": {"v=spf1 exists:a.example.com ptr exists:c.example.com ip4:192.0.2.1 -all"},
+	})
+	res, err := sc.ValidateResult("192.0.2.1", "two.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	res, err = sc.ValidateResult("192.0.2.1", "three.example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, PermError, res)
+}
+
+func TestMXWithoutRecords(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":       {"v=spf1 mx -all"},
+		"empty.example.com": {"v=spf1 mx mx:example.com ip4:192.0.2.0/24 -all"},
+		"three.example.com": {"v=spf1 mx mx:example.com mx:empty.example.com ip4:192.0.2.0/24 -all"},
+		"null.example.com":  {"v=spf1 mx ip4:192.0.2.0/24 -all"},
+	})
+	f.mx["empty.example.com"] = []*net.MX{}
+	// A null MX, per RFC 7505, names no host.
+	f.mx["null.example.com"] = []*net.MX{{Host: ".", Pref: 0}}
+
+	// An mx mechanism without hosts matches nothing, as a void lookup.
+	for domain, expected := range map[string]Result{
+		"example.com":       Fail,
+		"empty.example.com": Pass,
+		"null.example.com":  Pass,
+	} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err, domain)
+		assert.Equal(t, expected, res, domain)
+	}
+	res, err := sc.ValidateResult("192.0.2.1", "three.example.com")
+	assert.True(t, errors.Is(err, ErrTooManyVoidLookups))
+	assert.Equal(t, PermError, res)
+}
+
+func TestRecordSelection(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"none.example.com":     {"google-site-verification=abc"},
+		"multiple.example.com": {"v=spf1 -all", "v=spf1 +all"},
+		"one.example.com":      {"google-site-verification=abc", "v=spf1 -all"},
+		"version.example.com":  {"v=spf10 +all", "v=spf1x +all", "v=spf1 -all"},
+		"bare.example.com":     {"v=spf1"},
+		"spaced.example.com":   {"google-site-verification=abc", "  v=spf1  -all"},
+		"tabbed.example.com":   {"v=spf1\tip4:192.0.2.0/24\t-all"},
+		"upper.example.com":    {"google-site-verification=abc", "V=SPF1 -all"},
+		"mixed.example.com":    {"v=spf1 -all", "V=Spf1 +all"},
+	})
+	res, err := sc.ValidateResult("192.0.2.1", "none.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+
+	res, err = sc.ValidateResult("192.0.2.1", "multiple.example.com")
+	assert.Equal(t, ErrMultipleRecords, err)
+	assert.Equal(t, PermError, res)
+
+	res, err = sc.ValidateResult("192.0.2.1", "one.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+
+	// Only a whole v=spf1 term makes a record an SPF record.
+	res, err = sc.ValidateResult("192.0.2.1", "version.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	res, err = sc.ValidateResult("192.0.2.1", "bare.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Neutral, res)
+	res, err = sc.ValidateResult("192.0.2.1", "spaced.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	res, err = sc.ValidateResult("192.0.2.1", "tabbed.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	// The version is matched whatever its case, both to find a record and
+	// to find that there are too many.
+	record, err := sc.LookupRecord("upper.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "V=SPF1 -all", record)
+	res, err = sc.ValidateResult("192.0.2.1", "upper.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	res, err = sc.ValidateResult("192.0.2.1", "mixed.example.com")
+	assert.Equal(t, ErrMultipleRecords, err)
+	assert.Equal(t, PermError, res)
+}
+
+func TestMultipleRecordPolicy(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"multiple.example.com": {"google-site-verification=abc", "v=spf1 -all", "v=spf1 +all"},
+		"include.example.com":  {"v=spf1 include:multiple.example.com ?all"},
+	})
+	sc.MultipleRecords = MultipleRecordsUseFirst
+	record, err := sc.LookupRecord("multiple.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 -all", record)
+	res, err := sc.ValidateResult("192.0.2.1", "multiple.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+
+	// Included records are picked from the same way.
+	res, err = sc.ValidateResult("192.0.2.1", "include.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Neutral, res)
+}
+
+func TestACIDR(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":     {"v=spf1 a/24 -all"},
+		"v6.example.com":  {"v=spf1 a//64 -all"},
+		"bad.example.com": {"v=spf1 a/33 -all"},
+	})
+	f.ip["example.com"] = []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("198.51.100.20")}
+	f.ip["v6.example.com"] = []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8:1:2::10")}
+	for ip, expected := range map[string]Result{
+		"192.0.2.200":  Pass,
+		"198.51.100.1": Pass,
+		"203.0.113.1":  Fail,
+		"2001:db8::10": Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+	for ip, expected := range map[string]Result{
+		"192.0.2.10":       Pass,
+		"192.0.2.11":       Fail,
+		"2001:db8:1:2::ff": Pass,
+		"2001:db8:1:3::10": Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "v6.example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+	res, err := sc.ValidateResult("192.0.2.10", "bad.example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, PermError, res)
+}
+
+func TestAddressFamilies(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"dual.example.com": {"v=spf1 a mx:mx.example.com -all"},
+		"v4.example.com":   {"v=spf1 a:a.example.com a:b.example.com a:c.example.com ?all"},
+	})
+	f.ip["dual.example.com"] = []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}
+	f.mx["mx.example.com"] = []*net.MX{{Host: "mx4.example.com", Pref: 10}, {Host: "mx6.example.com", Pref: 20}}
+	f.ip["mx4.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	f.ip["mx6.example.com"] = []net.IP{net.ParseIP("2001:db8:1::1")}
+	for ip, expected := range map[string]Result{
+		"192.0.2.10":    Pass,
+		"2001:db8::10":  Pass,
+		"198.51.100.1":  Pass,
+		"2001:db8:1::1": Pass,
+		// An IPv4-mapped client is compared with the IPv4 addresses.
+		"::ffff:192.0.2.10": Pass,
+		"2001:db8::11":      Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "dual.example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+
+	// For an IPv6 client, hosts with only IPv4 addresses are void lookups.
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		f.ip[host] = []net.IP{net.ParseIP("192.0.2.1")}
+	}
+	res, err := sc.ValidateResult("192.0.2.2", "v4.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Neutral, res)
+	res, err = sc.ValidateResult("2001:db8::1", "v4.example.com")
+	assert.True(t, errors.Is(err, ErrTooManyVoidLookups), "%v", err)
+	assert.Equal(t, PermError, res)
+}
+
+func TestMXCIDR(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 mx/24//64 -all"},
+	})
+	f.mx["example.com"] = []*net.MX{{Host: "mx1.example.com", Pref: 10}, {Host: "mx2.example.com", Pref: 20}}
+	f.ip["mx1.example.com"] = []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("198.51.100.10")}
+	f.ip["mx2.example.com"] = []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8:1:2::10")}
+	for ip, expected := range map[string]Result{
+		"192.0.2.99":       Pass,
+		"198.51.100.99":    Pass,
+		"203.0.113.99":     Pass,
+		"2001:db8:1:2::99": Pass,
+		"192.0.3.10":       Fail,
+		"2001:db8:1:3::10": Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+}
+
+func TestMXLimit(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"ten.example.com":    {"v=spf1 mx -all"},
+		"eleven.example.com": {"v=spf1 ip4:192.0.2.1 mx -all"},
+	})
+	for i := 0; i < 11; i++ {
+		host := fmt.Sprintf("mx%d.example.com", i)
+		if i < 10 {
+			f.mx["ten.example.com"] = append(f.mx["ten.example.com"], &net.MX{Host: host, Pref: uint16(i)})
+		}
+		f.mx["eleven.example.com"] = append(f.mx["eleven.example.com"], &net.MX{Host: host, Pref: uint16(i)})
+		f.ip[host] = []net.IP{net.ParseIP(fmt.Sprintf("198.51.100.%d", i))}
+	}
+	res, err := sc.ValidateResult("198.51.100.9", "ten.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	// More MX records are a PermError, without their hosts being looked
+	// up.
+	atomic.StoreInt32(&f.queries, 0)
+	res, err = sc.ValidateResult("198.51.100.1", "eleven.example.com")
+	assert.Equal(t, PermError, res)
+	assert.True(t, errors.Is(err, ErrTooManyMXRecords), "%v", err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.queries))
+	// Unless the check is decided first.
+	res, err = sc.ValidateResult("192.0.2.1", "eleven.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	_, err = sc.Networks("eleven.example.com")
+	assert.True(t, errors.Is(err, ErrTooManyMXRecords), "%v", err)
+}
+
+func TestMXAddressLimit(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"ten.example.com":    {"v=spf1 mx -all"},
+		"eleven.example.com": {"v=spf1 mx -all"},
+	})
+	f.mx["ten.example.com"] = []*net.MX{{Host: "mx.ten.example.com"}}
+	f.mx["eleven.example.com"] = []*net.MX{{Host: "mx.eleven.example.com"}}
+	for i := 0; i < 11; i++ {
+		ip := net.ParseIP(fmt.Sprintf("198.51.100.%d", i))
+		if i < 10 {
+			f.ip["mx.ten.example.com"] = append(f.ip["mx.ten.example.com"], ip)
+		}
+		f.ip["mx.eleven.example.com"] = append(f.ip["mx.eleven.example.com"], ip)
+	}
+	res, err := sc.ValidateResult("198.51.100.9", "ten.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	// A host with more addresses is a PermError, even for one of them.
+	res, err = sc.ValidateResult("198.51.100.1", "eleven.example.com")
+	assert.Equal(t, PermError, res)
+	assert.True(t, errors.Is(err, ErrTooManyMXAddresses), "%v", err)
+	_, err = sc.Networks("eleven.example.com")
+	assert.True(t, errors.Is(err, ErrTooManyMXAddresses), "%v", err)
+}
+
+func TestExists(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":       {"v=spf1 exists:allow.example.com -all"},
+		"deny.example.com":  {"v=spf1 exists:nothing.example.com -all"},
+		"v6.example.com":    {"v=spf1 exists:v6only.example.com -all"},
+		"macro.example.com": {"v=spf1 exists:%{ir}.%{l}._spf.%{d} -all"},
+	})
+	f.ip["allow.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	f.ip["v6only.example.com"] = []net.IP{net.ParseIP("2001:db8::1")}
+	f.ip["1.2.0.192.alice._spf.macro.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	for _, c := range []struct {
+		ip, domain, sender string
+		expected           Result
+	}{
+		// Any A record matches, whatever the client's address.
+		{"192.0.2.1", "example.com", "", Pass},
+		{"2001:db8::2", "example.com", "", Pass},
+		{"192.0.2.1", "deny.example.com", "", Fail},
+		// Only A records are looked up, even for an IPv6 client.
+		{"2001:db8::1", "v6.example.com", "", Fail},
+		// The name is expanded before it is looked up.
+		{"192.0.2.1", "macro.example.com", "alice@macro.example.com", Pass},
+		{"192.0.2.1", "macro.example.com", "bob@macro.example.com", Fail},
+		{"192.0.2.2", "macro.example.com", "alice@macro.example.com", Fail},
+	} {
+		sender := c.sender
+		if sender == "" {
+			sender = "postmaster@" + c.domain
+		}
+		res, err := sc.ValidateMailFrom(c.ip, "mail.example.com", sender)
+		assert.Nil(t, err, "%s from %s", sender, c.ip)
+		assert.Equal(t, c.expected, res, "%s from %s", sender, c.ip)
+	}
+}
+
+func TestPTR(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 ptr -all"},
+	})
+	// Names are validated by looking up their addresses.
+	f.ptr["192.0.2.1"] = []string{"other.example.net.", "Mail.Example.com."}
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("192.0.2.1")}
+	f.ptr["192.0.2.2"] = []string{"spoof.example.com."}
+	f.ip["spoof.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	f.ptr["192.0.2.3"] = []string{"mail.example.net."}
+	f.ip["mail.example.net"] = []net.IP{net.ParseIP("192.0.2.3")}
+	// Only the first ten names are validated.
+	for i := 1; i <= 11; i++ {
+		host := fmt.Sprintf("h%d.example.com", i)
+		f.ptr["192.0.2.4"] = append(f.ptr["192.0.2.4"], host+".")
+		f.ip[host] = []net.IP{net.ParseIP("198.51.100.1")}
+	}
+	f.ip["h11.example.com"] = []net.IP{net.ParseIP("192.0.2.4"), net.ParseIP("192.0.2.5")}
+	f.ptr["192.0.2.5"] = f.ptr["192.0.2.4"][1:]
+
+	for ip, expected := range map[string]Result{
+		"192.0.2.1": Pass,
+		// A name that does not resolve back to the client is not its own.
+		"192.0.2.2": Fail,
+		// Nor is a validated name outside the domain a match.
+		"192.0.2.3": Fail,
+		// The eleventh name is ignored, though it would match as the tenth.
+		"192.0.2.4": Fail,
+		"192.0.2.5": Pass,
+		// An address without names does not match.
+		"192.0.2.6": Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err, ip)
+		assert.Equal(t, expected, res, ip)
+	}
+}
+
+func TestCIDROnlyTargetsCurrentDomain(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 mx/24 include:_spf.example.com -all"},
+		"_spf.example.com": {"v=spf1 a//64 -all"},
+	})
+	f.mx["example.com"] = []*net.MX{{Host: "mx.example.com", Pref: 10}}
+	f.ip["mx.example.com"] = []net.IP{net.ParseIP("192.0.2.10")}
+	// Within an include, the current domain is the included one.
+	f.ip["_spf.example.com"] = []net.IP{net.ParseIP("2001:db8:1:2::10")}
+	f.ip["example.com"] = []net.IP{net.ParseIP("2001:db8:ffff::10")}
+	for ip, expected := range map[string]Result{
+		"192.0.2.1":         Pass,
+		"192.0.2.255":       Pass,
+		"192.0.3.10":        Fail,
+		"2001:db8:1:2::ff":  Pass,
+		"2001:db8:ffff::10": Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+}
+
+func TestAMXDomains(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 a:www.example.net mx:%{d2}.example.net/24 -all"},
+	})
+	f.ip["www.example.net"] = []net.IP{net.ParseIP("192.0.2.10")}
+	f.mx["example.com.example.net"] = []*net.MX{{Host: "mx.example.net", Pref: 10}}
+	f.ip["mx.example.net"] = []net.IP{net.ParseIP("198.51.100.10")}
+	for ip, expected := range map[string]Result{
+		"192.0.2.10":    Pass,
+		"192.0.2.11":    Fail,
+		"198.51.100.99": Pass,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+}
+
+func TestMXDualStack(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 mx -all"},
+	})
+	f.mx["example.com"] = []*net.MX{{Host: "mail.example.com", Pref: 10}}
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}
+	for ip, expected := range map[string]Result{
+		"192.0.2.10":   Pass,
+		"2001:db8::10": Pass,
+		"192.0.2.11":   Fail,
+		"2001:db8::11": Fail,
+		// The IPv4-compatible form of the v4 address is not the v4 address.
+		"::c000:20a": Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+}
+
+func TestValidateMailFrom(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 exists:%{l}.%{h}.allow.example.com -all"},
+		"mail.example.net": {"v=spf1 ip4:192.0.2.1 -all"},
+		"mx.example.org":   {"v=spf1 exists:%{l}.%{o}.allow.example.com -all"},
+	})
+	f.ip["alice.mail.example.net.allow.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	f.ip["postmaster.mx.example.org.allow.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	res, err := sc.ValidateMailFrom("198.51.100.1", "mail.example.net", "alice@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateMailFrom("198.51.100.1", "mail.example.net", "<alice@example.com>")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateMailFrom("198.51.100.1", "mail.example.org", "alice@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+
+	// A null sender is checked against the HELO identity.
+	res, err = sc.ValidateMailFrom("192.0.2.1", "mail.example.net", "")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateMailFrom("198.51.100.1", "mail.example.net", "<>")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	res, err = sc.ValidateMailFrom("192.0.2.1", " mail.example.net ", " < > ")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	// Its sender is the HELO identity's postmaster.
+	res, err = sc.ValidateMailFrom("198.51.100.1", "mx.example.org", "<>")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	// Without a HELO identity either, there is nothing to check.
+	res, err = sc.ValidateMailFrom("192.0.2.1", "", "<>")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+
+	res, err = sc.ValidateMailFrom("192.0.2.1", "", "alice@")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+}
+
+func TestValidateHELO(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"mail.example.com": {"v=spf1 ip4:192.0.2.1 exists:%{l}.%{h}.%{d}.allow.example.com -all"},
+		"localhost":        {"v=spf1 +all"},
+	})
+	f.ip["postmaster.mail.example.com.mail.example.com.allow.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	res, err := sc.ValidateHELO("192.0.2.1", "mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateHELO("198.51.100.1", " mail.example.com. ")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	delete(f.ip, "postmaster.mail.example.com.mail.example.com.allow.example.com")
+	sc.DumpCache()
+	res, err = sc.ValidateHELO("198.51.100.1", "mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+
+	// Names that cannot have an SPF record are not looked up.
+	atomic.StoreInt32(&f.queries, 0)
+	for _, helo := range []string{"", "localhost", "[192.0.2.1]", "192.0.2.1", "[IPv6:2001:db8::1]", "2001:db8::1"} {
+		res, err = sc.ValidateHELO("192.0.2.1", helo)
+		assert.Nil(t, err, helo)
+		assert.Equal(t, None, res, helo)
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt32(&f.queries))
+}
+
+func TestValidateSender(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 exists:%{l}.%{d}._spf.example.com -all"},
+	})
+	f.ip["alice.example.com._spf.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	res, err := sc.ValidateSender("192.0.2.1", "alice@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateSender("192.0.2.1", "<bob@example.com>")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	// Validate checks on behalf of the domain's postmaster.
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	res, err = sc.ValidateSender("192.0.2.1", "<>")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+}
+
+func TestParallelLookups(t *testing.T) {
+	txt := map[string][]string{
+		"example.com": {"v=spf1 include:0.example.net include:1.example.net " +
+			"include:2.example.net mx:3.example.net ip4:192.0.2.1 -all"},
+	}
+	for i := 0; i < 3; i++ {
+		txt[fmt.Sprintf("%d.example.net", i)] = []string{"v=spf1 ip4:198.51.100.1 -all"}
+	}
+	_, f := fakeChecker(txt)
+	f.mx["3.example.net"] = []*net.MX{{Host: "mx1.example.net"}, {Host: "mx2.example.net"}}
+	f.ip["mx1.example.net"] = []net.IP{net.ParseIP("198.51.100.2")}
+	f.ip["mx2.example.net"] = []net.IP{net.ParseIP("198.51.100.3")}
+	g := &gatedResolver{f, make(chan chan struct{}, 12), make(chan struct{})}
+	sc := NewSPFCheckerWithResolver(g)
+
+	// The includes are all looked up before the first of them is answered.
+	results := make(chan Result)
+	go func() {
+		res, err := sc.ValidateResult("192.0.2.1", "example.com")
+		assert.Nil(t, err)
+		results <- res
+	}()
+	close(<-g.started)
+	for i := 0; i < 3; i++ {
+		<-g.started
+	}
+	close(g.release)
+	assert.Equal(t, Pass, <-results)
+	assert.EqualValues(t, 7, atomic.LoadInt32(&f.queries))
+
+	// The first match still decides, whatever was looked up ahead of it.
+	sc.DumpCache()
+	res, err := sc.ValidateResult("198.51.100.3", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateResult("203.0.113.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+}
+
+func TestIncludeResults(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"pass.example.com":      {"v=spf1 include:pass.example.net -all"},
+		"fail.example.com":      {"v=spf1 include:fail.example.net ?all"},
+		"softfail.example.com":  {"v=spf1 include:softfail.example.net ?all"},
+		"neutral.example.com":   {"v=spf1 include:neutral.example.net -all"},
+		"permerror.example.com": {"v=spf1 include:permerror.example.net +all"},
+		"none.example.com":      {"v=spf1 include:txt.example.net +all"},
+		"pass.example.net":      {"v=spf1 a -all"},
+		"fail.example.net":      {"v=spf1 -all exp=exp.example.net"},
+		"softfail.example.net":  {"v=spf1 ~all"},
+		"neutral.example.net":   {"v=spf1 ?all"},
+		"permerror.example.net": {"v=spf1 ip4:192.0.2.1/33"},
+		"txt.example.net":       {"not an SPF record"},
+		"exp.example.net":       {"not for included records"},
+	})
+	// The included record's mechanisms apply to its own domain.
+	f.ip["pass.example.net"] = []net.IP{net.ParseIP("192.0.2.1")}
+
+	for domain, expected := range map[string]Result{
+		"pass.example.com":      Pass,
+		"fail.example.com":      Neutral,
+		"softfail.example.com":  Neutral,
+		"neutral.example.com":   Fail,
+		"permerror.example.com": PermError,
+		"none.example.com":      PermError,
+	} {
+		ev, err := sc.Check("192.0.2.1", domain)
+		assert.Equal(t, expected, ev.Result, domain)
+		assert.Equal(t, expected == PermError, err != nil, "%s: %v", domain, err)
+		assert.Equal(t, "", ev.Explanation, domain)
+	}
+}
+
+func TestExplanation(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":          {"v=spf1 ip4:192.0.2.0/24 -all exp=explain.%{d}"},
+		"explain.example.com":  {"%{i} is not authorized to send mail for %{o} as %{s}"},
+		"soft.example.com":     {"v=spf1 ~all exp=explain.example.com"},
+		"missing.example.com":  {"v=spf1 -all exp=nothing.example.com"},
+		"multiple.example.com": {"v=spf1 -all exp=two.example.com"},
+		"two.example.com":      {"Not authorized", "Not allowed"},
+		"empty.example.com":    {"v=spf1 -all exp=none.example.com"},
+		"none.example.com":     {},
+	})
+	// The explanation is fetched and expanded on Fail.
+	ev, err := sc.Check("198.51.100.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, ev.Result)
+	assert.Equal(t, "198.51.100.1 is not authorized to send mail for example.com as postmaster@example.com", ev.Explanation)
+	ev, err = sc.Check("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, ev.Result)
+	assert.Equal(t, "", ev.Explanation)
+	ev, err = sc.Check("192.0.2.1", "soft.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, SoftFail, ev.Result)
+	assert.Equal(t, "", ev.Explanation)
+
+	// An explanation that cannot be had leaves the Fail without one.
+	for _, domain := range []string{"missing.example.com", "multiple.example.com", "empty.example.com"} {
+		ev, err := sc.Check("192.0.2.1", domain)
+		assert.Nil(t, err, domain)
+		assert.Equal(t, Fail, ev.Result, domain)
+		assert.Equal(t, "", ev.Explanation, domain)
+	}
+}
+
+func TestMatchedMechanism(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":             {"v=spf1 include:_spf.example.com ip4:198.51.100.0/24 ~all"},
+		"_spf.example.com":        {"v=spf1 -ip4:192.0.2.99 include:%{d2}.example.net ip6:2001:db8::/32 -all"},
+		"example.com.example.net": {"v=spf1 ip4:192.0.2.0/24"},
+		"rd.example.com":          {"v=spf1 redirect=example.com"},
+	})
+	for _, c := range []struct {
+		ip, domain string
+		result     Result
+		matched    string
+		trace      []string
+	}{
+		{"192.0.2.1", "example.com", Pass, "include:_spf.example.com",
+			[]string{"include:_spf.example.com", "include:%{d2}.example.net", "ip4:192.0.2.0/24"}},
+		{"2001:db8::1", "example.com", Pass, "include:_spf.example.com",
+			[]string{"include:_spf.example.com", "ip6:2001:db8::/32"}},
+		// The included record's Fail is not a match.
+		{"192.0.2.99", "example.com", SoftFail, "~all", []string{"~all"}},
+		{"198.51.100.1", "example.com", Pass, "ip4:198.51.100.0/24", []string{"ip4:198.51.100.0/24"}},
+		{"198.51.100.1", "rd.example.com", Pass, "ip4:198.51.100.0/24",
+			[]string{"redirect=example.com", "ip4:198.51.100.0/24"}},
+	} {
+		ev, err := sc.Check(c.ip, c.domain)
+		assert.Nil(t, err)
+		assert.Equal(t, c.result, ev.Result, c.ip)
+		assert.Equal(t, c.matched, ev.Matched, c.ip)
+		assert.Equal(t, c.trace, ev.Trace, c.ip)
+	}
+
+	sc, _ = fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 include:_spf.example.com"},
+		"_spf.example.com": {"v=spf1 -all"},
+	})
+	ev, err := sc.Check("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Neutral, ev.Result)
+	assert.Equal(t, "", ev.Matched)
+	assert.Nil(t, ev.Trace)
+}
+
+func TestEvaluatedDomain(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":          {"v=spf1 include:_spf.example.com redirect=_spf.provider.net"},
+		"_spf.example.com":     {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_spf.provider.net":    {"v=spf1 ip4:198.51.100.0/24 redirect=_spf2.provider.net"},
+		"_spf2.provider.net":   {"v=spf1 ip4:203.0.113.0/24"},
+		"customer.example.org": {"v=spf1 redirect=example.com"},
+	})
+	for _, c := range []struct {
+		ip, domain string
+		result     Result
+		evaluated  string
+	}{
+		// A match within an include is decided by the including record.
+		{"192.0.2.1", "example.com", Pass, "example.com"},
+		{"198.51.100.1", "example.com", Pass, "_spf.provider.net"},
+		{"203.0.113.1", "example.com", Pass, "_spf2.provider.net"},
+		{"203.0.113.1", "customer.example.org", Pass, "_spf2.provider.net"},
+		// A record that nothing matches decides its Neutral result too.
+		{"2001:db8::1", "customer.example.org", Neutral, "_spf2.provider.net"},
+		{"2001:db8::1", "none.example.org", None, ""},
+	} {
+		ev, err := sc.Check(c.ip, c.domain)
+		assert.Nil(t, err)
+		assert.Equal(t, c.result, ev.Result, "%s from %s", c.domain, c.ip)
+		assert.Equal(t, c.evaluated, ev.EvaluatedDomain, "%s from %s", c.domain, c.ip)
+	}
+}
+
+func TestPrefixLengthRange(t *testing.T) {
+	for record, reason := range map[string]string{
+		"v=spf1 ip4:192.0.2.0/40 -all":   `CIDR prefix length "40" is not a number from 0 to 32`,
+		"v=spf1 ip6:2001:db8::/129 -all": `CIDR prefix length "129" is not a number from 0 to 128`,
+		"v=spf1 ip4:192.0.2.0/-1 -all":   `CIDR prefix length "-1" is not a number from 0 to 32`,
+		"v=spf1 ip4:192.0.2.0/024 -all":  `CIDR prefix length "024" is not a number from 0 to 32`,
+		"v=spf1 ip4:192.0.2.0/ -all":     "missing prefix length",
+		"v=spf1 ip4:192.0.2.256 -all":    `invalid IPv4 address "192.0.2.256"`,
+	} {
+		res, _, err := checkRecord("192.0.2.1", "example.com", record)
+		assert.Equal(t, PermError, res, record)
+		if assert.IsType(t, &SyntaxError{}, err, record) {
+			assert.Equal(t, reason, err.(*SyntaxError).Reason, record)
+		}
+	}
+	checkResult(t, Pass, "192.0.2.1", "v=spf1 ip4:0.0.0.0/0 -all")
+	checkResult(t, Pass, "2001:db8::1", "v=spf1 ip6:::/0 -all")
+	checkResult(t, Pass, "2001:db8::1", "v=spf1 ip6:2001:db8::1/128 -all")
+}
+
+func TestExplicitPassQualifier(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"bare.example.com":     {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 include:_spf.example.com -all"},
+		"explicit.example.com": {"v=spf1 +ip4:192.0.2.0/24 +ip6:2001:db8::/32 +include:_spf.example.com -all"},
+		"_spf.example.com":     {"v=spf1 +ip4:198.51.100.0/24"},
+	})
+	bare, err := ParseRecord("v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 include:_spf.example.com -all")
+	assert.Nil(t, err)
+	explicit, err := ParseRecord("v=spf1 +ip4:192.0.2.0/24 +ip6:2001:db8::/32 +include:_spf.example.com -all")
+	assert.Nil(t, err)
+	assert.Equal(t, bare, explicit)
+
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1", "198.51.100.1", "203.0.113.1"} {
+		want, err := sc.ValidateResult(ip, "bare.example.com")
+		assert.Nil(t, err)
+		got, err := sc.ValidateResult(ip, "explicit.example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, want, got, ip)
+	}
+	checkResult(t, Pass, "198.51.100.1", "v=spf1 +ip4:198.51.100.1 -all")
+}
+
+func TestQualifiedLookupMechanisms(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"mx.example.com":      {"v=spf1 -mx +all"},
+		"a.example.com":       {"v=spf1 ~a:host.example.com/24 ?mx:example.com//64 +all"},
+		"exists.example.com":  {"v=spf1 ?exists:%{ir}.allow.example.com -exists:%{ir}.deny.example.com +all"},
+		"include.example.com": {"v=spf1 ~include:_spf.example.com -all"},
+		"_spf.example.com":    {"v=spf1 +ptr:example.com"},
+	})
+	f.mx["mx.example.com"] = []*net.MX{{Host: "mail.example.com", Pref: 10}}
+	f.mx["example.com"] = []*net.MX{{Host: "mail.example.com", Pref: 10}}
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+	f.ip["host.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	f.ip["1.2.0.192.allow.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	f.ip["2.2.0.192.deny.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	f.ptr["203.0.113.1"] = []string{"mail.example.com."}
+	f.ip["mail.example.com"] = append(f.ip["mail.example.com"], net.ParseIP("203.0.113.1"))
+
+	// Each mechanism that makes lookups gives the result of its own
+	// qualifier when it matches.
+	for _, c := range []struct {
+		ip, domain string
+		expected   Result
+	}{
+		{"192.0.2.1", "mx.example.com", Fail},
+		{"2001:db8::1", "mx.example.com", Fail},
+		{"198.51.100.99", "mx.example.com", Pass},
+		{"198.51.100.99", "a.example.com", SoftFail},
+		{"2001:db8::ffff", "a.example.com", Neutral},
+		{"203.0.113.99", "a.example.com", Pass},
+		{"192.0.2.1", "exists.example.com", Neutral},
+		{"192.0.2.2", "exists.example.com", Fail},
+		{"192.0.2.3", "exists.example.com", Pass},
+		{"203.0.113.1", "include.example.com", SoftFail},
+		{"203.0.113.2", "include.example.com", Fail},
+	} {
+		res, err := sc.ValidateResult(c.ip, c.domain)
+		assert.Nil(t, err, "%s from %s", c.domain, c.ip)
+		assert.Equal(t, c.expected, res, "%s from %s", c.domain, c.ip)
+	}
+}
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"V=spf1 IP4:192.0.2.0/24 Include:_spf.example.com A:Mail.Example.com MX Exists:%{L}.Example.com -ALL"},
+		"_spf.example.com": {"v=SPF1 Ip6:2001:db8::/32"},
+	})
+	f.ip["Mail.Example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	f.mx["example.com"] = []*net.MX{{Host: "mx.example.com"}}
+	f.ip["mx.example.com"] = []net.IP{net.ParseIP("198.51.100.2")}
+	// Macros expand in the case of the sender, not of the record.
+	f.ip["postmaster.Example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	for ip, matched := range map[string]string{
+		"192.0.2.1":    "ip4:192.0.2.0/24",
+		"2001:db8::1":  "include:_spf.example.com",
+		"198.51.100.1": "a:Mail.Example.com",
+		"198.51.100.2": "mx",
+		"203.0.113.1":  "exists:%{L}.Example.com",
+	} {
+		ev, err := sc.Check(ip, "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, Pass, ev.Result, ip)
+		assert.Equal(t, matched, ev.Matched, ip)
+	}
+
+	rec, err := ParseRecord("V=spf1 A:Mail.Example.com -ALL")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "a", rec.Mechanisms[0].Kind)
+		assert.Equal(t, "Mail.Example.com", rec.Mechanisms[0].Value)
+		assert.Equal(t, "all", rec.Mechanisms[1].Kind)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":          {"v=spf1 a4:192.0.2.1 ip4:192.0.2.1 unknown-mod=x -all"},
+		"include.example.com":  {"v=spf1 include:_spf.example.com -all"},
+		"_spf.example.com":     {"v=spf1 ipv4:192.0.2.1 ip4:192.0.2.1"},
+		"modifier.example.com": {"v=spf1 ip4:192.0.2.1 x-anything=%{d} -all"},
+		"twice.example.com":    {"v=spf1 ip4:192.0.2.1 ~all -all"},
+	})
+	for _, domain := range []string{"example.com", "include.example.com", "modifier.example.com"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err)
+		assert.Equal(t, Pass, res, domain)
+	}
+	// A second all is never reached.
+	res, err := sc.ValidateResult("198.51.100.1", "twice.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, SoftFail, res)
+
+	sc.Strict = true
+	for _, domain := range []string{"example.com", "include.example.com"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Equal(t, PermError, res, domain)
+		if assert.IsType(t, &SyntaxError{}, err, domain) {
+			assert.Equal(t, "unknown mechanism", err.(*SyntaxError).Reason)
+		}
+	}
+	res, err = sc.ValidateResult("198.51.100.1", "twice.example.com")
+	assert.Equal(t, PermError, res)
+	if assert.IsType(t, &SyntaxError{}, err) {
+		assert.Equal(t, "more than one all in record", err.(*SyntaxError).Reason)
+	}
+	res, err = sc.ValidateResult("192.0.2.1", "modifier.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+}
+
+func TestTreatSoftFailAsFail(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.com ~ip4:198.51.100.0/24 ?all"},
+		"_spf.example.com": {"v=spf1 ip4:203.0.113.0/24 ~all"},
+		"soft.example.com": {"v=spf1 ip4:192.0.2.0/24 ~all"},
+		"exp.example.com":  {"v=spf1 ~all exp=why.example.com"},
+		"why.example.com":  {"%{i} is not one of %{d}'s"},
+	})
+	sc.TreatSoftFailAsFail = true
+	for _, c := range []struct {
+		ip, domain, matched string
+		expected            Result
+	}{
+		{"198.51.100.1", "example.com", "~ip4:198.51.100.0/24", Fail},
+		{"2001:db8::1", "soft.example.com", "~all", Fail},
+		{"192.0.2.1", "soft.example.com", "ip4:192.0.2.0/24", Pass},
+		// A SoftFail within an include is still no match.
+		{"10.0.0.1", "example.com", "?all", Neutral},
+	} {
+		ev, err := sc.Check(c.ip, c.domain)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, ev.Result, "%s from %s", c.domain, c.ip)
+		assert.Equal(t, c.matched, ev.Matched, "%s from %s", c.domain, c.ip)
+	}
+	// A SoftFail made a Fail is explained as one.
+	ev, err := sc.Check("192.0.2.1", "exp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, ev.Result)
+	assert.Equal(t, "192.0.2.1 is not one of exp.example.com's", ev.Explanation)
+
+	sc.TreatSoftFailAsFail = false
+	res, err := sc.ValidateResult("2001:db8::1", "soft.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, SoftFail, res)
+	ev, err = sc.Check("192.0.2.1", "exp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, SoftFail, ev.Result)
+	assert.Equal(t, "", ev.Explanation)
+}
+
+func TestAllowedIncludes(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":            {"v=spf1 include:_spf.provider.example include:other.example ip4:192.0.2.0/24 -all"},
+		"_spf.provider.example":  {"v=spf1 include:_nets.provider.example include:partner.example"},
+		"_nets.provider.example": {"v=spf1 ip4:198.51.100.0/24"},
+		"partner.example":        {"v=spf1 ip4:203.0.113.0/24"},
+		"other.example":          {"v=spf1 ip4:10.0.0.0/8"},
+		"trusted.example.com":    {"v=spf1 include:_spf.provider.example -all"},
+	})
+	sc.AllowedIncludes = []string{"provider.example."}
+	ev, err := sc.Check("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, ev.Result)
+	// The includes of an allowed domain's records are not reported.
+	assert.Equal(t, []string{"example.com: include:other.example is not of an allowed domain"}, ev.Warnings)
+	ev, err = sc.Check("192.0.2.1", "trusted.example.com")
+	assert.Nil(t, err)
+	assert.Nil(t, ev.Warnings)
+
+	sc, _ = fakeChecker(map[string][]string{
+		"example.com":           {"v=spf1 include:_spf.provider.example include:other.example -all"},
+		"_spf.provider.example": {"v=spf1 ip4:198.51.100.0/24"},
+		"other.example":         {"v=spf1 ip4:10.0.0.0/8"},
+	})
+	sc.AllowedIncludes = []string{"provider.example"}
+	sc.Strict = true
+	res, err := sc.ValidateResult("198.51.100.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	res, err = sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Equal(t, PermError, res)
+	assert.True(t, errors.Is(err, ErrUntrustedInclude), "%v", err)
+}
+
+func TestValidateIP(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+	})
+	for ip, expected := range map[string]Result{
+		"192.0.2.1":   Pass,
+		"2001:db8::1": Pass,
+		"203.0.113.1": Fail,
+	} {
+		res, err := sc.ValidateIP(net.ParseIP(ip), "example.com")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+	res, err := sc.ValidateIP(net.IPv4(192, 0, 2, 1).To4(), "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	for _, ip := range []net.IP{nil, {}, {192, 0, 2}} {
+		res, err := sc.ValidateIP(ip, "example.com")
+		assert.Equal(t, ErrInvalidIP, err)
+		assert.Equal(t, PermError, res)
+	}
+}
+
+func TestValidateAnyIP(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 a:relay.example.com mx ~all"},
+	})
+	f.ip["relay.example.com"] = []net.IP{net.ParseIP("192.0.2.1")}
+	f.mx["example.com"] = []*net.MX{{Host: "mx.example.com", Pref: 10}}
+	f.ip["mx.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+
+	res, ip, err := sc.ValidateAnyIP([]string{"203.0.113.1", "198.51.100.1", "192.0.2.1"}, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	assert.Equal(t, "198.51.100.1", ip)
+	// The lookups of the first IP's check served the second's.
+	assert.EqualValues(t, 4, atomic.LoadInt32(&f.queries))
+
+	res, ip, err = sc.ValidateAnyIP([]string{"203.0.113.1", "203.0.113.2"}, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, SoftFail, res)
+	assert.Equal(t, "", ip)
+	res, ip, err = sc.ValidateAnyIP([]string{"192.0.2.1"}, "missing.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+	assert.Equal(t, "", ip)
+
+	for _, ips := range [][]string{nil, {"192.0.2.1", "not-an-ip"}} {
+		res, _, err = sc.ValidateAnyIP(ips, "example.com")
+		assert.True(t, errors.Is(err, ErrInvalidIP), "%v", ips)
+		assert.Equal(t, PermError, res)
+	}
+}
+
+func TestInvalidClientIP(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com": {"v=spf1 +all"},
+	})
+	for _, ip := range []string{"", "192.0.2", "192.0.2.256", "not-an-ip", "2001:db8:::1"} {
+		ok, err := sc.Validate(ip, "example.com")
+		assert.False(t, ok, ip)
+		if assert.NotNil(t, err, ip) {
+			assert.True(t, errors.Is(err, ErrInvalidIP), ip)
+			assert.Contains(t, err.Error(), fmt.Sprintf("%q", ip))
+		}
+		res, _ := sc.ValidateMailFrom(ip, "mail.example.com", "alice@example.com")
+		assert.Equal(t, PermError, res, ip)
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt32(&f.queries), "nothing is looked up for an invalid IP")
+
+	res, err := sc.ValidateResult(" 192.0.2.1 ", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+}
+
+func TestIPv4MappedClient(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"v4.example.com":     {"v=spf1 ip4:1.2.3.0/24 -all"},
+		"v6.example.com":     {"v=spf1 ip6:::ffff:0:0/96 ip6:2001:db8::/32 -all"},
+		"a.example.com":      {"v=spf1 a:mail.example.com -all"},
+		"exists.example.com": {"v=spf1 exists:%{ir}.%{v}.example.com -all"},
+	})
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("1.2.3.4")}
+	f.ip["4.3.2.1.in-addr.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	for domain, expected := range map[string]Result{
+		"v4.example.com": Pass,
+		// A mapped address is an IPv4 client, so ip6 mechanisms do not
+		// match it, even one naming the mapped range.
+		"v6.example.com":     Fail,
+		"a.example.com":      Pass,
+		"exists.example.com": Pass,
+	} {
+		for _, ip := range []string{"::ffff:1.2.3.4", "::ffff:102:304"} {
+			res, err := sc.ValidateResult(ip, domain)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, res, "%s from %s", domain, ip)
+		}
+		res, err := sc.ValidateIP(net.ParseIP("::ffff:1.2.3.4"), domain)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, domain)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"include.example.com":  {"v=spf1 include:1.example.com -all"},
+		"1.example.com":        {"v=spf1 include:2.example.com -all"},
+		"2.example.com":        {"v=spf1 include:3.example.com -all"},
+		"3.example.com":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"redirect.example.com": {"v=spf1 redirect=r1.example.com"},
+		"r1.example.com":       {"v=spf1 include:1.example.com redirect=r2.example.com"},
+		"r2.example.com":       {"v=spf1 -all"},
+	})
+	for depth, expected := range map[int]Result{0: Pass, 2: PermError, 3: Pass} {
+		sc.MaxDepth = depth
+		res, err := sc.ValidateResult("192.0.2.1", "include.example.com")
+		assert.Equal(t, expected, res, "depth %d", depth)
+		if expected == PermError {
+			assert.Equal(t, permError{ErrTooDeep}, err)
+		}
+	}
+	// Redirects count towards the depth along with includes.
+	for depth, expected := range map[int]Result{3: PermError, 4: Pass} {
+		sc.MaxDepth = depth
+		res, _ := sc.ValidateResult("192.0.2.1", "redirect.example.com")
+		assert.Equal(t, expected, res, "depth %d", depth)
+	}
+}
+
+func TestValidateRecord(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 -all"},
+		"_spf.example.com": {"v=spf1 ip4:198.51.100.0/24 -all"},
+	})
+	f.ip["example.com"] = []net.IP{net.ParseIP("203.0.113.1")}
+	record := "v=spf1 ip4:192.0.2.0/24 include:_spf.example.com a -exists:%{i}.example.com ~all"
+	for ip, expected := range map[string]Result{
+		"192.0.2.1":    Pass,
+		"198.51.100.1": Pass,
+		"203.0.113.1":  Pass,
+		"203.0.113.2":  SoftFail,
+	} {
+		res, err := sc.ValidateRecord(ip, "example.com", record)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res, ip)
+	}
+
+	// The published record is not looked up, nor cached in place of the
+	// given one.
+	_, _, cached, _ := sc.cached("example.com")
+	assert.False(t, cached)
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+
+	for _, record := range []string{"", "ip4:192.0.2.0/24 -all", "v=spf1 ip4:192.0.2.0/33"} {
+		res, err := sc.ValidateRecord("192.0.2.1", "example.com", record)
+		assert.NotNil(t, err, record)
+		assert.Equal(t, PermError, res, record)
+	}
+	res, err = sc.ValidateRecord("not-an-ip", "example.com", "v=spf1 +all")
+	assert.True(t, errors.Is(err, ErrInvalidIP))
+	assert.Equal(t, PermError, res)
+}
+
+func TestNoMatchIsNeutral(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"bare.example.com":     {"v=spf1"},
+		"ip4.example.com":      {"v=spf1 ip4:198.51.100.0/24"},
+		"include.example.com":  {"v=spf1 include:_spf.example.com"},
+		"_spf.example.com":     {"v=spf1 -all"},
+		"exp.example.com":      {"v=spf1 exp=explain.example.com"},
+		"explain.example.com":  {"Not authorized"},
+		"modifier.example.com": {"v=spf1 x-custom=anything"},
+		"spaces.example.com":   {"v=spf1 "},
+		"blank.example.com":    {"v=spf1 \t  \r\n"},
+	})
+	for _, domain := range []string{"bare.example.com", "ip4.example.com", "include.example.com", "exp.example.com", "modifier.example.com",
+		"spaces.example.com", "blank.example.com"} {
+		ev, err := sc.Check("192.0.2.1", domain)
+		assert.Nil(t, err, domain)
+		assert.Equal(t, Neutral, ev.Result, domain)
+		assert.Equal(t, "", ev.Matched, domain)
+		assert.Equal(t, "", ev.Explanation, domain)
+		// Neutral is no authorization, but is not a Fail either.
+		ok, err := sc.Validate("192.0.2.1", domain)
+		assert.Nil(t, err, domain)
+		assert.False(t, ok, domain)
+	}
+	checkResult(t, Neutral, "192.0.2.1", "v=spf1 ")
+
+	// A record of nothing but whitespace is no SPF record at all.
+	txt := map[string][]string{"empty.example.com": {"   "}, "split.example.com": {" ", "v=spf1"}}
+	sc, _ = fakeChecker(txt)
+	res, err := sc.ValidateResult("192.0.2.1", "empty.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, None, res)
+	res, err = sc.ValidateResult("192.0.2.1", "split.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Neutral, res)
+}
+
+func TestRedirectPrecedence(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"all.example.com":     {"v=spf1 include:_spf.example.com ~all redirect=rd.example.com"},
+		"first.example.com":   {"v=spf1 redirect=rd.example.com include:_spf.example.com -all"},
+		"broken.example.com":  {"v=spf1 include:_spf.example.com -all redirect=missing.example.com"},
+		"noall.example.com":   {"v=spf1 include:_spf.example.com redirect=rd.example.com"},
+		"_spf.example.com":    {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"rd.example.com":      {"v=spf1 ip4:198.51.100.0/24 ?all"},
+		"nomatch.example.com": {"v=spf1 include:_spf.example.com ip4:203.0.113.0/24 redirect=rd.example.com"},
+	})
+	for _, c := range []struct {
+		ip, domain string
+		expected   Result
+	}{
+		// The mechanisms are evaluated first, wherever the redirect is, and
+		// an all leaves nothing for it.
+		{"192.0.2.1", "all.example.com", Pass},
+		{"198.51.100.1", "all.example.com", SoftFail},
+		{"192.0.2.1", "first.example.com", Pass},
+		{"198.51.100.1", "first.example.com", Fail},
+		{"198.51.100.1", "broken.example.com", Fail},
+		// The all of an included record only decides the include.
+		{"192.0.2.1", "noall.example.com", Pass},
+		{"198.51.100.1", "noall.example.com", Pass},
+		{"203.0.113.1", "noall.example.com", Neutral},
+		{"203.0.113.1", "nomatch.example.com", Pass},
+		{"198.51.100.1", "nomatch.example.com", Pass},
+	} {
+		res, err := sc.ValidateResult(c.ip, c.domain)
+		assert.Nil(t, err, "%s from %s", c.domain, c.ip)
+		assert.Equal(t, c.expected, res, "%s from %s", c.domain, c.ip)
+	}
+
+	// Where an all matches, the redirect target is never looked up.
+	before := atomic.LoadInt32(&f.queries)
+	sc.DumpCache()
+	res, err := sc.ValidateResult("198.51.100.1", "broken.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, res)
+	assert.Equal(t, before+2, atomic.LoadInt32(&f.queries))
+}
+
+func TestOverlongNames(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":  {"v=spf1 exists:%{l}.example.com -all"},
+		"long.example": {"v=spf1 exists:%{l}.%{l}.%{l}.%{l}.%{l}.example.com -all"},
+	})
+	label := strings.Repeat("a", 60)
+	f.ip[strings.Repeat(label+".", 3)+"example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	// A local-part too long to be a label cannot be looked up.
+	res, err := sc.ValidateMailFrom("192.0.2.1", "mail.example.com", strings.Repeat("x", 64)+"@example.com")
+	assert.Equal(t, PermError, res)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "label longer than 63")
+	}
+	// A name that is too long is shortened from the left.
+	res, err = sc.ValidateMailFrom("192.0.2.1", "mail.example.com", label+"@long.example")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+
+	for _, record := range []string{
+		"v=spf1 exists:" + strings.Repeat("x", 64) + ".example.com -all",
+		"v=spf1 include:" + strings.Repeat(label+".", 5) + "example.com -all",
+		"v=spf1 a:www..example.com -all",
+	} {
+		assert.IsType(t, &SyntaxError{}, CheckSyntax(record), record)
+	}
+}
+
+func TestIncludeWithoutRecord(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"missing.example.com": {"v=spf1 ip4:192.0.2.0/24 include:nothing.example.com -all"},
+		"txt.example.com":     {"v=spf1 include:_spf.example.com -all"},
+		"_spf.example.com":    {"google-site-verification=abc"},
+		"empty.example.com":   {"v=spf1 include:_empty.example.com -all"},
+		"_empty.example.com":  {},
+	})
+	for domain, expected := range map[string]error{
+		"missing.example.com": ErrNoTXTRecords,
+		"txt.example.com":     ErrNoSPFRecordInTXT,
+		"empty.example.com":   ErrNoSPFRecordInTXT,
+	} {
+		res, err := sc.ValidateResult("198.51.100.1", domain)
+		assert.Equal(t, PermError, res, domain)
+		assert.True(t, errors.Is(err, expected), "%s: %v", domain, err)
+		assert.Contains(t, err.Error(), "include of", domain)
+	}
+	// A mechanism matching ahead of the include decides the check first.
+	res, err := sc.ValidateResult("192.0.2.1", "missing.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+}
+
+func TestIncludeRedirectWithoutRecord(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 include:_spf.example.com -all"},
+		"_spf.example.com": {"v=spf1 redirect=missing.example.com"},
+	})
+	// The redirect's error is a PermError however deeply it is wrapped.
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Equal(t, PermError, res)
+	assert.True(t, errors.Is(err, ErrNoTXTRecords), "%v", err)
+	assert.Contains(t, err.Error(), "redirect to missing.example.com")
+}
+
+func TestTrailingDot(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 include:_spf.example.com. a:mail.example.com. exists:%{d}.example.net. -all"},
+		"_spf.example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+	})
+	f.ip["mail.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	f.ip["example.com.example.net"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	for _, domain := range []string{"example.com", "example.com."} {
+		for _, ip := range []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"} {
+			res, err := sc.ValidateResult(ip, domain)
+			assert.Nil(t, err)
+			assert.Equal(t, Pass, res, "%s from %s", domain, ip)
+		}
+	}
+	// Both forms of the domain share a cache entry.
+	atomic.StoreInt32(&f.queries, 0)
+	sc.DumpCache()
+	for _, domain := range []string{"example.com.", "example.com"} {
+		_, err := sc.LookupRecord(domain)
+		assert.Nil(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries))
+}
+
+func TestInternationalizedDomains(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"xn--bcher-kva.example": {"v=spf1 exists:%{o}._spf.example.net -all"},
+	})
+	f.ip["xn--bcher-kva.example._spf.example.net"] = []net.IP{net.ParseIP("127.0.0.2")}
+	for _, domain := range []string{"bücher.example", "BÜCHER.example.", "xn--bcher-kva.example"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Nil(t, err, domain)
+		assert.Equal(t, Pass, res, domain)
+	}
+	res, err := sc.ValidateMailFrom("192.0.2.1", "mail.example.com", "user@bücher.example")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+}
+
+func TestExplain(t *testing.T) {
+	sc, _ := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 ip4:198.51.100.0/24 include:_spf.example.com -all"},
+		"_spf.example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"rd.example.com":   {"v=spf1 a:none.example.com redirect=example.com"},
+		"open.example.com": {"v=spf1 ip4:198.51.100.0/24"},
+		"all.example.com":  {"v=spf1 ~all"},
+		"bad.example.com":  {"v=spf1 ip4:192.0.2.0/33"},
+	})
+	for _, c := range []struct {
+		ip, domain  string
+		result      Result
+		explanation string
+	}{
+		{"203.0.113.1", "example.com", Fail,
+			"IP 203.0.113.1 did not match any of: ip4:198.51.100.0/24, include:_spf.example.com; record ends in -all"},
+		{"198.51.100.1", "example.com", Pass, "IP 198.51.100.1 matched ip4:198.51.100.0/24"},
+		{"192.0.2.1", "example.com", Pass, "IP 192.0.2.1 matched include:_spf.example.com, through ip4:192.0.2.0/24"},
+		{"203.0.113.1", "rd.example.com", Fail,
+			"IP 203.0.113.1 did not match any of: a:none.example.com, ip4:198.51.100.0/24, include:_spf.example.com; " +
+				"record ends in -all, in the record of example.com that rd.example.com redirects to"},
+		{"203.0.113.1", "open.example.com", Neutral,
+			"IP 203.0.113.1 did not match any of: ip4:198.51.100.0/24; record has no all mechanism"},
+		{"203.0.113.1", "all.example.com", SoftFail, "IP 203.0.113.1 matched only ~all"},
+		{"203.0.113.1", "none.example.com", None, "none.example.com publishes no SPF record"},
+	} {
+		res, explanation, err := sc.Explain(c.ip, c.domain)
+		assert.Nil(t, err)
+		assert.Equal(t, c.result, res, c.domain)
+		assert.Equal(t, c.explanation, explanation, c.domain)
+	}
+
+	res, explanation, err := sc.Explain("192.0.2.1", "bad.example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, PermError, res)
+	assert.Equal(t, "checking IP 192.0.2.1 against the SPF record of bad.example.com failed: "+err.Error(), explanation)
+}
+
+func TestErrorClasses(t *testing.T) {
+	txt := map[string][]string{
+		"lookups.example.com":  {"v=spf1 a a a a a a a a a a a -all"},
+		"voids.example.com":    {"v=spf1 a:1.example.net a:2.example.net a:3.example.net -all"},
+		"loop.example.com":     {"v=spf1 redirect=loop2.example.com"},
+		"loop2.example.com":    {"v=spf1 include:loop.example.com -all"},
+		"syntax.example.com":   {"v=spf1 ip4:192.0.2.0/33 -all"},
+		"include.example.com":  {"v=spf1 include:multiple.example.com -all"},
+		"multiple.example.com": {"v=spf1 -all", "v=spf1 +all"},
+		"nested.example.com":   {"v=spf1 include:syntax.example.com -all"},
+		"rdsyntax.example.com": {"v=spf1 redirect=syntax.example.com"},
+	}
+	sc, f := fakeChecker(txt)
+	f.ip["lookups.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	for domain, expected := range map[string]error{
+		"lookups.example.com":  ErrTooManyLookups,
+		"voids.example.com":    ErrTooManyVoidLookups,
+		"loop.example.com":     ErrLoop,
+		"syntax.example.com":   ErrSyntax,
+		"include.example.com":  ErrMultipleRecords,
+		"multiple.example.com": ErrMultipleRecords,
+		"nested.example.com":   ErrSyntax,
+		"none.example.com":     nil,
+	} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		if expected == nil {
+			assert.Nil(t, err, domain)
+			continue
+		}
+		assert.Equal(t, PermError, res, domain)
+		assert.True(t, errors.Is(err, expected), "%s: %v", domain, err)
+	}
+
+	for _, domain := range []string{"syntax.example.com", "nested.example.com", "rdsyntax.example.com"} {
+		res, err := sc.ValidateResult("192.0.2.1", domain)
+		assert.Equal(t, PermError, res, domain)
+		assert.True(t, errors.Is(err, ErrMalformedRecord), "%s: %v", domain, err)
+	}
+
+	var syntaxErr *SyntaxError
+	_, err := sc.ValidateResult("192.0.2.1", "nested.example.com")
+	if assert.True(t, errors.As(err, &syntaxErr)) {
+		assert.Equal(t, "ip4:192.0.2.0/33", syntaxErr.Term)
+	}
+
+	f.fail["temp.example.com"] = &net.DNSError{Err: "server misbehaving", Name: "temp.example.com", IsTemporary: true}
+	txt["redirect.example.com"] = []string{"v=spf1 redirect=temp.example.com"}
+	res, err := sc.ValidateResult("192.0.2.1", "redirect.example.com")
+	assert.Equal(t, TempError, res)
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.True(t, dnsErr.Temporary())
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	_, f := fakeChecker(map[string][]string{
+		"_spf.example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+	})
+	rec, err := ParseRecord("v=spf1 include:_spf.example.com -all exp=%{d}.example.net")
+	assert.Nil(t, err)
+	ev, err := Evaluate(context.Background(), f, rec, net.ParseIP("192.0.2.1"), "Example.com.", "user@example.com", "mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, ev.Result)
+	assert.Equal(t, "include:_spf.example.com", ev.Matched)
+	// The record itself is not looked up, only the one it includes.
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.queries))
+
+	ev, err = Evaluate(context.Background(), f, rec, net.ParseIP("::ffff:198.51.100.1"), "example.com", "user@example.com", "")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, ev.Result)
+
+	ev, err = Evaluate(context.Background(), f, rec, nil, "example.com", "user@example.com", "")
+	assert.Equal(t, ErrInvalidIP, err)
+	assert.Equal(t, PermError, ev.Result)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ev, err = Evaluate(ctx, f, rec, net.ParseIP("192.0.2.1"), "example.com", "user@example.com", "")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, TempError, ev.Result)
+
+	// The null sender is postmaster@ the domain.
+	f.ip["postmaster.example.com.example.net"] = []net.IP{net.ParseIP("127.0.0.2")}
+	rec, err = ParseRecord("v=spf1 exists:%{l}.%{o}.example.net -all")
+	assert.Nil(t, err)
+	ev, err = Evaluate(context.Background(), f, rec, net.ParseIP("192.0.2.1"), "example.com", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, ev.Result)
+	assert.Equal(t, DNSSECUnknown, ev.DNSSEC)
+
+	// A Checker evaluates records with its settings.
+	sc := NewSPFCheckerWithResolver(f)
+	sc.TreatSoftFailAsFail = true
+	sc.MaxDepth = 1
+	rec, err = ParseRecord("v=spf1 ip4:198.51.100.0/24 ~all")
+	assert.Nil(t, err)
+	ev, err = sc.Evaluate(context.Background(), rec, net.ParseIP("192.0.2.1"), "example.com", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, Fail, ev.Result)
+	f.txt["a.example.com"] = []string{"v=spf1 include:b.example.com"}
+	f.txt["b.example.com"] = []string{"v=spf1 +all"}
+	rec, err = ParseRecord("v=spf1 include:a.example.com -all")
+	assert.Nil(t, err)
+	ev, err = sc.Evaluate(context.Background(), rec, net.ParseIP("192.0.2.1"), "example.com", "", "")
+	assert.True(t, errors.Is(err, ErrTooDeep), "%v", err)
+	assert.Equal(t, PermError, ev.Result)
+}
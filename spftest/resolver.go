@@ -0,0 +1,241 @@
+// Package spftest provides an in-memory resolver for testing SPF checks
+// without DNS.
+package spftest
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// FakeResolver answers DNS lookups from records registered with it, and
+// satisfies spf.Resolver. Names are compared case-insensitively, with or
+// without a trailing dot; a name with nothing registered of the type looked
+// up does not exist. It is safe for concurrent use, and records can be
+// registered between checks. The zero value has no records and is ready for
+// use.
+type FakeResolver struct {
+	mu       sync.Mutex
+	txt      map[string][]string
+	ip       map[string][]net.IP
+	mx       map[string][]*net.MX
+	ptr      map[string][]string
+	failures map[string]*net.DNSError
+	queries  int32
+}
+
+// NewFakeResolver returns a FakeResolver without any records.
+func NewFakeResolver() *FakeResolver {
+	return new(FakeResolver)
+}
+
+// canonical returns the form of a name that records are registered under.
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// AddTXT registers TXT records for a name, each given as the concatenation
+// of its strings.
+func (r *FakeResolver) AddTXT(name string, records ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.txt == nil {
+		r.txt = make(map[string][]string)
+	}
+	r.txt[canonical(name)] = append(r.txt[canonical(name)], records...)
+}
+
+// AddA registers IPv4 addresses for a host. It panics if one is not an IPv4
+// address.
+func (r *FakeResolver) AddA(host string, addrs ...string) {
+	r.addIPs(host, addrs, true)
+}
+
+// AddAAAA registers IPv6 addresses for a host. It panics if one is not an
+// IPv6 address.
+func (r *FakeResolver) AddAAAA(host string, addrs ...string) {
+	r.addIPs(host, addrs, false)
+}
+
+func (r *FakeResolver) addIPs(host string, addrs []string, v4 bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ip == nil {
+		r.ip = make(map[string][]net.IP)
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		// IPv6 addresses are written with colons, even those mapping IPv4
+		// ones.
+		if ip == nil || strings.Contains(addr, ":") == v4 {
+			panic("spftest: wrong kind of address for record: " + addr)
+		}
+		r.ip[canonical(host)] = append(r.ip[canonical(host)], ip)
+	}
+}
+
+// AddMX registers an MX record for a name, of a mail host with the given
+// preference.
+func (r *FakeResolver) AddMX(name, host string, pref uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mx == nil {
+		r.mx = make(map[string][]*net.MX)
+	}
+	mxs := append(r.mx[canonical(name)], &net.MX{Host: host, Pref: pref})
+	// Lookups return MX records by preference, as net.Resolver does.
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	r.mx[canonical(name)] = mxs
+}
+
+// AddPTR registers the names that an address's reverse lookup finds. It
+// panics if addr is not an IP address.
+func (r *FakeResolver) AddPTR(addr string, names ...string) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		panic("spftest: not an IP address: " + addr)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ptr == nil {
+		r.ptr = make(map[string][]string)
+	}
+	r.ptr[ip.String()] = append(r.ptr[ip.String()], names...)
+}
+
+// SetTimeout makes every lookup of a name fail at once with a timeout, as
+// an unresponsive server would.
+func (r *FakeResolver) SetTimeout(name string) {
+	r.fail(name, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true})
+}
+
+// SetNotFound makes every lookup of a name find that it does not exist,
+// whatever is registered for it, as an NXDOMAIN response would.
+func (r *FakeResolver) SetNotFound(name string) {
+	r.fail(name, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true})
+}
+
+// SetServerFailure makes every lookup of a name fail temporarily, as a
+// SERVFAIL response would.
+func (r *FakeResolver) SetServerFailure(name string) {
+	r.fail(name, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true})
+}
+
+func (r *FakeResolver) fail(name string, err *net.DNSError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures == nil {
+		r.failures = make(map[string]*net.DNSError)
+	}
+	r.failures[canonical(name)] = err
+}
+
+// Clear removes everything registered for a name, failures included.
+func (r *FakeResolver) Clear(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = canonical(name)
+	delete(r.txt, name)
+	delete(r.ip, name)
+	delete(r.mx, name)
+	delete(r.failures, name)
+	if ip := net.ParseIP(name); ip != nil {
+		delete(r.ptr, ip.String())
+	}
+}
+
+// Queries returns the number of lookups made so far.
+func (r *FakeResolver) Queries() int {
+	return int(atomic.LoadInt32(&r.queries))
+}
+
+// query counts a lookup of a name and returns the error it fails with, if
+// any.
+func (r *FakeResolver) query(ctx context.Context, name string) error {
+	atomic.AddInt32(&r.queries, 1)
+	if err := ctx.Err(); err != nil {
+		return &net.DNSError{Err: err.Error(), Name: name, IsTimeout: err == context.DeadlineExceeded}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.failures[canonical(name)]; err != nil {
+		return err
+	}
+	return nil
+}
+
+// notFound returns the error for a lookup finding nothing.
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// LookupTXT returns the TXT records registered for a name.
+func (r *FakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := r.query(ctx, name); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	txt, ok := r.txt[canonical(name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return append([]string(nil), txt...), nil
+}
+
+// LookupIPAddr returns the IPv4 and IPv6 addresses registered for a host.
+func (r *FakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if err := r.query(ctx, host); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ips, ok := r.ip[canonical(host)]
+	if !ok {
+		return nil, notFound(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
+}
+
+// LookupMX returns the MX records registered for a name, by preference.
+func (r *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if err := r.query(ctx, name); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mxs, ok := r.mx[canonical(name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	out := make([]*net.MX, len(mxs))
+	for i, mx := range mxs {
+		copied := *mx
+		out[i] = &copied
+	}
+	return out, nil
+}
+
+// LookupAddr returns the names registered for an address by AddPTR.
+func (r *FakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := r.query(ctx, addr); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	if ip := net.ParseIP(addr); ip != nil {
+		names = r.ptr[ip.String()]
+	}
+	if len(names) == 0 {
+		return nil, notFound(addr)
+	}
+	return append([]string(nil), names...), nil
+}
@@ -0,0 +1,93 @@
+package spftest_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	spf "github.com/cathalgarvey/gospf"
+	"github.com/cathalgarvey/gospf/spftest"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ spf.Resolver = (*spftest.FakeResolver)(nil)
+
+func TestFakeResolver(t *testing.T) {
+	r := spftest.NewFakeResolver()
+	r.AddTXT("Example.com.", "v=spf1 a mx ptr:example.com -all", "other")
+	r.AddA("example.com", "192.0.2.1")
+	r.AddAAAA("example.com", "2001:db8::1")
+	r.AddMX("example.com", "mx2.example.com", 20)
+	r.AddMX("example.com", "mx1.example.com", 10)
+	r.AddA("mx1.example.com", "198.51.100.1")
+	r.AddPTR("203.0.113.1", "mail.example.com.")
+	r.AddA("mail.example.com", "203.0.113.1")
+	ctx := context.Background()
+
+	txt, err := r.LookupTXT(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=spf1 a mx ptr:example.com -all", "other"}, txt)
+	addrs, err := r.LookupIPAddr(ctx, "EXAMPLE.COM")
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, addrs)
+	mxs, err := r.LookupMX(ctx, "example.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, []*net.MX{{Host: "mx1.example.com", Pref: 10}, {Host: "mx2.example.com", Pref: 20}}, mxs)
+	names, err := r.LookupAddr(ctx, "203.0.113.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mail.example.com."}, names)
+	_, err = r.LookupMX(ctx, "mx1.example.com")
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+	assert.Equal(t, 5, r.Queries())
+
+	assert.Panics(t, func() { r.AddA("example.com", "2001:db8::2") })
+	assert.Panics(t, func() { r.AddAAAA("example.com", "192.0.2.2") })
+
+	sc := spf.NewSPFCheckerWithResolver(r)
+	for ip, expected := range map[string]spf.Result{
+		"192.0.2.1":    spf.Pass,
+		"2001:db8::1":  spf.Pass,
+		"198.51.100.1": spf.Pass,
+		"203.0.113.1":  spf.Pass,
+		"203.0.113.2":  spf.Fail,
+	} {
+		res, err := sc.ValidateResult(ip, "example.com")
+		assert.Nil(t, err, ip)
+		assert.Equal(t, expected, res, ip)
+	}
+}
+
+func TestFakeResolverFailures(t *testing.T) {
+	r := spftest.NewFakeResolver()
+	r.AddTXT("timeout.example.com", "v=spf1 -all")
+	r.AddTXT("servfail.example.com", "v=spf1 -all")
+	r.AddTXT("gone.example.com", "v=spf1 -all")
+	r.SetTimeout("timeout.example.com")
+	r.SetServerFailure("servfail.example.com")
+	r.SetNotFound("gone.example.com")
+	sc := spf.NewSPFCheckerWithResolver(r)
+
+	for domain, expected := range map[string]spf.Result{
+		"timeout.example.com":  spf.TempError,
+		"servfail.example.com": spf.TempError,
+		"gone.example.com":     spf.None,
+	} {
+		res, _ := sc.ValidateResult("192.0.2.1", domain)
+		assert.Equal(t, expected, res, domain)
+	}
+
+	r.Clear("timeout.example.com")
+	r.AddTXT("timeout.example.com", "v=spf1 +all")
+	res, err := sc.ValidateResult("192.0.2.1", "timeout.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, spf.Pass, res)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = r.LookupTXT(ctx, "timeout.example.com")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,20 @@
+package spf
+
+// Tracer receives the steps of SPF checks as they are made, for
+// troubleshooting records. Its methods may be called from more than one
+// goroutine at once.
+type Tracer interface {
+	// Lookup is called for each DNS lookup made, with the type of records
+	// looked up ("TXT", "SPF", "IP", "MX" or "PTR") and the name.
+	Lookup(kind, name string)
+	// Mechanism is called for each mechanism of a domain's record that is
+	// evaluated, with whether it matched and any error that ended the
+	// check.
+	Mechanism(domain, mechanism string, matched bool, err error)
+	// Redirect is called when a domain's record is replaced by that of
+	// the target of its redirect modifier.
+	Redirect(domain, target string)
+	// LookupCount is called with the number of terms requiring DNS lookups
+	// evaluated so far, each time it grows.
+	LookupCount(n int)
+}
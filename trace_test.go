@@ -0,0 +1,80 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTracer records the events it is told of as strings.
+type recordingTracer struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingTracer) add(format string, args ...interface{}) {
+	r.mu.Lock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *recordingTracer) Lookup(kind, name string) {
+	r.add("lookup %s %s", kind, name)
+}
+
+func (r *recordingTracer) Mechanism(domain, mechanism string, matched bool, err error) {
+	r.add("%s: %s matched=%v err=%v", domain, mechanism, matched, err)
+}
+
+func (r *recordingTracer) Redirect(domain, target string) {
+	r.add("%s: redirect to %s", domain, target)
+}
+
+func (r *recordingTracer) LookupCount(n int) {
+	r.add("lookups %d", n)
+}
+
+func TestTracer(t *testing.T) {
+	sc, f := fakeChecker(map[string][]string{
+		"example.com":      {"v=spf1 ip4:198.51.100.0/24 include:_spf.example.com redirect=rd.example.com"},
+		"_spf.example.com": {"v=spf1 -all"},
+		"rd.example.com":   {"v=spf1 a -all"},
+	})
+	f.ip["rd.example.com"] = []net.IP{net.ParseIP("192.0.2.1")}
+	tracer := new(recordingTracer)
+	sc.Tracer = tracer
+
+	res, err := sc.ValidateResult("192.0.2.1", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Pass, res)
+	// Lookups are started ahead of the mechanisms that need them, so their
+	// order among the other events is not fixed.
+	var lookups, others []string
+	for _, event := range tracer.events {
+		if strings.HasPrefix(event, "lookup ") {
+			lookups = append(lookups, event)
+		} else {
+			others = append(others, event)
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"lookup TXT example.com",
+		"lookup TXT _spf.example.com",
+		"lookup TXT rd.example.com",
+		"lookup IP rd.example.com",
+	}, lookups)
+	assert.Equal(t, []string{
+		"example.com: ip4:198.51.100.0/24 matched=false err=<nil>",
+		"lookups 1",
+		"_spf.example.com: -all matched=true err=<nil>",
+		"example.com: include:_spf.example.com matched=false err=<nil>",
+		"lookups 2",
+		"example.com: redirect to rd.example.com",
+		"lookups 3",
+		"rd.example.com: a matched=true err=<nil>",
+	}, others)
+}